@@ -1,9 +1,11 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"github.com/prataprc/liner"
 	"io"
+	"sync"
 )
 
 const (
@@ -26,6 +28,10 @@ type Context struct {
 	W        io.Writer // output for this application
 	Shells   map[string]ShellHandler
 	Commands CommandMap
+
+	mu     sync.Mutex
+	ctx    context.Context    // of the in-flight command
+	cancel context.CancelFunc // cancels ctx
 }
 
 // Interface to be implemented by individual shells
@@ -101,6 +107,45 @@ func (c *Context) ShellCommands(shname string) CommandMap {
 	return commands
 }
 
+// BeginCommand sets up a context for the command about to be interpreted,
+// which is cancelled by CancelCommand. `end` must be called once the
+// command is done.
+func (c *Context) BeginCommand() (end func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.ctx, c.cancel = ctx, cancel
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		c.ctx, c.cancel = nil, nil
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// CancelCommand cancels the in-flight command, like on ctrl-C, returns
+// false if no command is in-flight.
+func (c *Context) CancelCommand() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel == nil {
+		return false
+	}
+	c.cancel()
+	return true
+}
+
+// Ctx returns the context of in-flight command, commands pass it on to
+// operations that can be cancelled.
+func (c *Context) Ctx() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 func (c *Context) Close() {
 	c.Liner.Close()
 	c.Cursh.Close(c)
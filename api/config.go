@@ -1,215 +1,215 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path"
-	"text/template"
-	"time"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type Config map[string]interface{}
 type Environ map[string]string
 
-func LoadConfig(context Config, configfile, dirname string) (Config, error) {
-	var err error
-	var data []byte
+// Source is a configuration file, as it is before overlay and template
+// expansion, that contributed to a loaded configuration.
+type Source struct {
+	File       string
+	Config     Config
+	Provenance Provenance
+}
+
+// LoadConfig loads configuration from `configfile` and overlays its include
+// files on it, followed by the selected profile and `overrides`. Templates
+// in the overlaid configuration are expanded using `context` and the result
+// is decoded into validated settings. If `configfile` is relative, it is
+// resolved with `dirname`, or with current working directory if `dirname`
+// is empty string.
+func LoadConfig(
+	context Config, configfile, dirname string, overrides ...*Override) (*Settings, error) {
 
-	config := make(Config)
+	sources := make([]*Source, 0)
 	configfile = ResolveFile(configfile, dirname)
-	if data, err = ioutil.ReadFile(configfile); err != nil {
+	config, prov, err := loadConfig(configfile, "", &sources)
+	if err != nil {
 		return nil, err
 	}
-	if err = json.Unmarshal(data, &config); err != nil {
+	if config, prov, err = selectProfile(config, prov, overrides); err != nil {
 		return nil, err
 	}
-
-	if context == nil {
-		context = make(Config)
-	}
-	if config, err = expandConfig(context, config); err != nil {
+	config = StripOverlay(config, prov)
+	if err = applyOverrides(config, prov, overrides); err != nil {
 		return nil, err
 	}
-	if context, err = Overlay(context, config); err != nil {
+	secrets := NewSecrets(configSecretsFile(config, configfile))
+	if config, err = ExpandConfig(context, config, prov, secrets); err != nil {
 		return nil, err
 	}
-	return LoadNestedConfig(context, config, path.Dir(configfile))
-}
-
-func LoadNestedConfig(context, config Config, dirname string) (Config, error) {
-	sources := []Config{config}
-	if includeFiles, ok := config["include"].([]interface{}); ok {
-		for _, includeFile := range includeFiles {
-			config, err := LoadConfig(context, includeFile.(string), dirname)
-			if err != nil {
-				return nil, err
-			}
-			sources = append(sources, config)
-		}
-	} else if includeFile, ok := config["include"].(interface{}); ok {
-		config, err := LoadConfig(context, includeFile.(string), dirname)
-		if err != nil {
-			return nil, err
-		}
-		sources = append(sources, config)
+	settings, err := DecodeSettings(config, prov, sources, configfile)
+	if err != nil {
+		return nil, err
 	}
-	return Overlay(sources...)
+	settings.SecretsFile = secrets.File
+	return settings, nil
 }
 
-func expandTerm(context Config, term interface{}) (interface{}, error) {
-	if sl, ok := term.([]interface{}); ok {
-		return expandSlice(context, sl)
-	} else if m, ok := term.(map[string]interface{}); ok {
-		return expandConfig(context, m)
-	} else {
-		return expandString(context, term)
+// configSecretsFile returns the secrets file for `config` loaded from
+// `configfile`.
+func configSecretsFile(config Config, configfile string) string {
+	if file, ok := config[SECRETS_KEY].(string); ok && file != "" {
+		return ResolveFile(file, path.Dir(configfile))
 	}
-	return term, nil
+	return DefaultSecretsFile()
 }
 
-func expandSlice(context Config, sl []interface{}) ([]interface{}, error) {
-	newsl := make([]interface{}, 0, len(sl))
-	for _, s := range sl {
-		if term, err := expandTerm(context, s); err != nil {
-			return nil, err
-		} else {
-			newsl = append(newsl, term)
-		}
-	}
-	return newsl, nil
-}
+func loadConfig(
+	configfile, dirname string, sources *[]*Source) (Config, Provenance, error) {
 
-func expandConfig(context, config Config) (Config, error) {
-	var ncontext Config
 	var err error
+	var data []byte
+	var prov Provenance
+	var config Config
 
-	if ncontext, err = Overlay(context, config); err != nil {
-		return nil, err
+	configfile = ResolveFile(configfile, dirname)
+	if data, err = ioutil.ReadFile(configfile); err != nil {
+		return nil, nil, err
 	}
-	newconfig := make(Config)
-	for key, value := range config {
-		if term, err := expandTerm(ncontext, value); err != nil {
-			return nil, err
-		} else {
-			newconfig[key] = term
-		}
+	if config, prov, err = decodeConfig(configfile, data); err != nil {
+		return nil, nil, err
 	}
-	return newconfig, nil
+	source := &Source{File: configfile, Config: config, Provenance: prov}
+	*sources = append(*sources, source)
+	return LoadNestedConfig(source, path.Dir(configfile), sources)
 }
 
-func expandString(context Config, value interface{}) (interface{}, error) {
-	if s, ok := value.(string); ok {
-		for i := 0; i < 10; i++ {
-			buf := bytes.NewBuffer([]byte{})
-			t := template.New(fmt.Sprintln(time.Now().UnixNano()))
-			if t, err := t.Parse(s); err != nil {
-				return nil, err
-			} else if err = t.Execute(buf, context); err != nil {
-				return nil, err
-			}
-			s = string(buf.Bytes())
-		}
-		return s, nil
-	}
-	return value, nil
-}
+// LoadNestedConfig loads include files of `source` and overlays them on top
+// of `source`. Every loaded file is appended to `sources`.
+func LoadNestedConfig(
+	source *Source, dirname string, sources *[]*Source) (Config, Provenance, error) {
 
-// GetProgramConfig extracts program configuration from master configuration.
-func (config *Config) GetProgramConfig(name string) *Config {
-	programs := (*config)["programs"].([]interface{})
-	for _, program := range programs {
-		prog := program.(Config)
-		if prog["name"] == name {
-			return &prog
-		}
+	includeFiles, err := includeFiles(source.Config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", source.File, err)
 	}
-	return nil
-}
-
-// TargetHost returns program's host name/ip from configuration.
-func (config *Config) TargetHost(name string) string {
-	pconf := config.GetProgramConfig(name)
-	return (*pconf)["targethost"].(string)
-}
-
-// TargetRoot returns program's root directory from configuration.
-func (config *Config) TargetRoot(name string) string {
-	pconf := config.GetProgramConfig(name)
-	v := (*pconf)["targetroot"]
-	if s, ok := v.(string); ok {
-		return s
+	configs := []Config{source.Config}
+	provs := []Provenance{source.Provenance}
+	for _, includeFile := range includeFiles {
+		config, prov, err := loadConfig(includeFile, dirname, sources)
+		if err != nil {
+			return nil, nil, err
+		}
+		configs, provs = append(configs, config), append(provs, prov)
+	}
+	return OverlayProvenance(configs, provs)
+}
+
+// includeFiles returns the list of files specified by "include" property,
+// which can either be a string or a list of strings.
+func includeFiles(config Config) ([]string, error) {
+	switch include := config["include"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{include}, nil
+	case []interface{}:
+		files := make([]string, 0, len(include))
+		for _, item := range include {
+			if file, ok := item.(string); ok {
+				files = append(files, file)
+			} else {
+				return nil, fmt.Errorf("include: expected file name, got %v", typeName(item))
+			}
+		}
+		return files, nil
 	}
-	return ""
+	return nil, fmt.Errorf("include: expected file name or list of file names")
 }
 
-// TargetHost returns slice of program's source repositories
-func (config *Config) Repository(name string) []interface{} {
-	pconf := config.GetProgramConfig(name)
-	return (*pconf)["repository"].([]interface{})
+// WalkConfig calls `fn` for every property in `config` with its key path.
+// Nested properties and lists of properties are descended into, elements
+// of a list are identified by their "name" property or by their index.
+func WalkConfig(config Config, fn func(key string, value interface{})) {
+	walkTerm("", map[string]interface{}(config), fn)
 }
 
-// User returns username to use for ssh login.
-func (config *Config) User(name string) (user string) {
-	if name != "" {
-		pconf := config.GetProgramConfig(name)
-		user, _ = (*pconf)["user"].(string)
+func walkTerm(key string, term interface{}, fn func(key string, value interface{})) {
+	if m, ok := asProperty(term); ok && len(m) > 0 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			walkTerm(joinKey(key, k), m[k], fn)
+		}
+		return
 	}
-	if user == "" {
-		user = (*config)["user"].(string)
+	if sl, ok := term.([]interface{}); ok && hasProperty(sl) {
+		for i, item := range sl {
+			walkTerm(elementKey(key, i, item), item, fn)
+		}
+		return
 	}
-	return user
-}
-
-// SshPoolSize returns allowed ssh clients in a connection pool
-func (config *Config) SshPoolSize() int {
-	return int((*config)["ssh.pool.size"].(float64))
-}
-
-// SshPoolOverflow returns allowed overflow of ssh clients in a connection pool
-func (config *Config) SshPoolOverflow() int {
-	return int((*config)["ssh.pool.overflow"].(float64))
+	fn(key, term)
 }
 
-// LogMaxsize returns maximum in-memory log lines
-func (config *Config) LogMaxsize() int {
-	return int((*config)["log.maxsize"].(float64))
-}
-
-// LogMaxsize returns maximum in-memory log lines
-func (config *Config) LogColor(name string) string {
-	pconf := config.GetProgramConfig(name)
-	color, _ := (*pconf)["log.color"].(string)
-	return color
+func hasProperty(sl []interface{}) bool {
+	for _, item := range sl {
+		if _, ok := asProperty(item); ok {
+			return true
+		}
+	}
+	return false
 }
 
-// ProgramEnviron extracts environment from program configuration and returns
-// a map of key, value string.
-func (config *Config) ProgramEnviron(name string) Environ {
-	if name != "" {
-		config = config.GetProgramConfig(name)
-	}
-	environ := make(map[string]string)
-	if confenv, ok := (*config)["environ"].(Config); ok {
-		for key, i := range confenv {
-			environ[key] = i.(string)
+// LookupKey returns the value of property addressed by key path, like
+// "programs[indexer].log.color". Since property names can contain dots,
+// the longest matching name is picked at each level.
+func LookupKey(config Config, key string) (interface{}, bool) {
+	var term interface{} = map[string]interface{}(config)
+	for key != "" {
+		if key[0] == '[' {
+			sl, ok := term.([]interface{})
+			end := strings.IndexByte(key, ']')
+			if !ok || end < 0 {
+				return nil, false
+			}
+			if term, ok = lookupElement(sl, key[1:end]); !ok {
+				return nil, false
+			}
+			key = strings.TrimPrefix(key[end+1:], ".")
+			continue
 		}
+		m, ok := asProperty(term)
+		if !ok {
+			return nil, false
+		}
+		name := ""
+		for k := range m {
+			if len(k) > len(name) && (key == k ||
+				strings.HasPrefix(key, k+".") || strings.HasPrefix(key, k+"[")) {
+				name = k
+			}
+		}
+		if name == "" {
+			return nil, false
+		}
+		term, key = m[name], strings.TrimPrefix(key[len(name):], ".")
 	}
-	return environ
+	return term, true
 }
 
-// ProgramCommand returns the remote command and its argument.
-func (config *Config) ProgramCommand(name string) string {
-	if name != "" {
-		config = config.GetProgramConfig(name)
-	}
-	command := (*config)["command"].(string)
-	args := (*config)["commandargs"]
-	if args != nil {
-		for _, arg := range args.([]interface{}) {
-			command += " " + arg.(string)
+// lookupElement picks an element from list by its "name" property or by
+// its index.
+func lookupElement(sl []interface{}, id string) (interface{}, bool) {
+	for _, item := range sl {
+		if m, ok := asProperty(item); ok && m["name"] == id {
+			return item, true
 		}
 	}
-	return command
+	if i, err := strconv.Atoi(id); err == nil && i >= 0 && i < len(sl) {
+		return sl[i], true
+	}
+	return nil, false
 }
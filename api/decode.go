@@ -0,0 +1,204 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+// configDecoder decodes configuration file `file` from `data` and returns
+// the configuration along with the origin of its properties.
+type configDecoder func(file string, data []byte) (Config, Provenance, error)
+
+// configDecoders are picked by configuration file's extension, files with
+// other extensions are decoded as strict JSON.
+var configDecoders = map[string]configDecoder{
+	".json":  decodeJSON,
+	".jsonc": decodeJSONC,
+	".yaml":  decodeYAML,
+	".yml":   decodeYAML,
+	".toml":  decodeTOML,
+}
+
+// decodeConfig decodes configuration file `file` from `data`, using the
+// decoder for its extension.
+func decodeConfig(file string, data []byte) (Config, Provenance, error) {
+	decoder, ok := configDecoders[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		decoder = decodeJSON
+	}
+	return decoder(file, data)
+}
+
+func decodeJSON(file string, data []byte) (Config, Provenance, error) {
+	config := make(Config)
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", file, err)
+	}
+	prov, err := fileProvenance(file, data, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, prov, nil
+}
+
+// decodeJSONC decodes JSON with comments, both // and /* */ style, and
+// with trailing commas in objects and lists.
+func decodeJSONC(file string, data []byte) (Config, Provenance, error) {
+	return decodeJSON(file, stripJSONC(data))
+}
+
+// stripJSONC blanks out comments and trailing commas in `data`. Newlines
+// are left intact so that line numbers in errors and provenance still
+// point into the original file.
+func stripJSONC(data []byte) []byte {
+	out := append([]byte{}, data...)
+	blank := func(from, till int) {
+		for i := from; i < till; i++ {
+			if out[i] != '\n' {
+				out[i] = ' '
+			}
+		}
+	}
+	comma := -1 // offset of a comma that could be trailing
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case c == '"':
+			comma = -1
+			for i++; i < len(out) && out[i] != '"'; i++ {
+				if out[i] == '\\' {
+					i++
+				}
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			end := bytes.IndexByte(out[i:], '\n')
+			if end < 0 {
+				end = len(out) - i
+			}
+			blank(i, i+end)
+			i += end - 1
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				blank(i, len(out))
+				return out
+			}
+			blank(i, i+end+4)
+			i += end + 3
+		case c == ',':
+			comma = i
+		case c == '}' || c == ']':
+			if comma >= 0 {
+				out[comma] = ' '
+			}
+			comma = -1
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		default:
+			comma = -1
+		}
+	}
+	return out
+}
+
+func decodeYAML(file string, data []byte) (Config, Provenance, error) {
+	var node yaml.Node
+	var value interface{}
+
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", file, err)
+	} else if err = node.Decode(&value); err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", file, err)
+	}
+	config, err := normalizeConfig(file, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	prov := make(Provenance)
+	if len(node.Content) > 0 {
+		yamlProvenance(file, "", node.Content[0], config, prov)
+	}
+	return config, prov, nil
+}
+
+// yamlProvenance records the origin of every property under `node`, which
+// decoded to `term`.
+func yamlProvenance(file, key string, node *yaml.Node, term interface{}, prov Provenance) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		m, _ := asProperty(term)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			childKey := joinKey(key, name)
+			prov[childKey] = []Origin{{file, node.Content[i].Line}}
+			yamlProvenance(file, childKey, node.Content[i+1], m[name], prov)
+		}
+	case yaml.SequenceNode:
+		sl, _ := term.([]interface{})
+		for i, child := range node.Content {
+			var item interface{}
+			if i < len(sl) {
+				item = sl[i]
+			}
+			elemKey := elementKey(key, i, item)
+			prov[elemKey] = []Origin{{file, child.Line}}
+			yamlProvenance(file, elemKey, child, item, prov)
+		}
+	case yaml.AliasNode:
+		yamlProvenance(file, key, node.Alias, term, prov)
+	}
+}
+
+// decodeTOML decodes TOML configuration, the TOML decoder does not report
+// positions, so the origin of properties have no line numbers.
+func decodeTOML(file string, data []byte) (Config, Provenance, error) {
+	var value map[string]interface{}
+
+	if _, err := toml.Decode(string(data), &value); err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", file, err)
+	}
+	config, err := normalizeConfig(file, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	prov := make(Provenance)
+	termProvenance(Origin{File: file}, "", map[string]interface{}(config), prov)
+	return config, prov, nil
+}
+
+// termProvenance records `origin` for every property under `term`.
+func termProvenance(origin Origin, key string, term interface{}, prov Provenance) {
+	if m, ok := asProperty(term); ok {
+		for name, value := range m {
+			childKey := joinKey(key, name)
+			prov[childKey] = []Origin{origin}
+			termProvenance(origin, childKey, value, prov)
+		}
+	} else if sl, ok := term.([]interface{}); ok {
+		for i, item := range sl {
+			elemKey := elementKey(key, i, item)
+			prov[elemKey] = []Origin{origin}
+			termProvenance(origin, elemKey, item, prov)
+		}
+	}
+}
+
+// normalizeConfig converts `value` decoded from YAML or TOML into the same
+// types as decoded from JSON, so that rest of the loader need not care about
+// the file format.
+func normalizeConfig(file string, value interface{}) (Config, error) {
+	config := make(Config)
+	if value == nil {
+		return config, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	} else if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%v: expected properties at top-level", file)
+	}
+	return config, nil
+}
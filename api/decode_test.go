@@ -0,0 +1,41 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStripJSONC(t *testing.T) {
+	testcases := []struct {
+		in  string
+		out string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{`{"a": 1} // comment`, `{"a": 1}           `},
+		{"{\"a\": 1, // comment\n\"b\": 2}", "{\"a\": 1,           \n\"b\": 2}"},
+		{`{"a": /* comment */ 1}`, `{"a":               1}`},
+		{"{\"a\": /* multi\nline */ 1}", "{\"a\":         \n        1}"},
+		{`{"a": 1,}`, `{"a": 1 }`},
+		{`{"a": [1, 2, ], }`, `{"a": [1, 2  ]  }`},
+		{"{\"a\": 1, // trailing\n}", "{\"a\": 1             \n}"},
+		{`{"a": 1, /* c */ }`, `{"a": 1          }`},
+		{`{"url": "http://host/x", "b": ",}"}`, `{"url": "http://host/x", "b": ",}"}`},
+		{`{"a": "/* not a comment */"}`, `{"a": "/* not a comment */"}`},
+		{`{"a": "quote \" // not a comment"}`, `{"a": "quote \" // not a comment"}`},
+		{`{"a": 1} /* unterminated`, `{"a": 1}                `},
+	}
+	for _, tc := range testcases {
+		out := string(stripJSONC([]byte(tc.in)))
+		if out != tc.out {
+			t.Errorf("stripJSONC(%q): expected %q, got %q", tc.in, tc.out, out)
+		}
+		if len(out) != len(tc.in) || strings.Count(out, "\n") != strings.Count(tc.in, "\n") {
+			t.Errorf("stripJSONC(%q): changed offsets or lines", tc.in)
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(out), &v); err != nil && !strings.Contains(tc.in, "unterminated") {
+			t.Errorf("stripJSONC(%q): invalid JSON %v", tc.in, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StartOrder returns `names` ordered such that programs come after the
+// programs they depend on, directly or through programs not in `names`.
+// Otherwise programs are in the order of configuration. Stop programs in
+// the reverse order.
+func (settings *Settings) StartOrder(names []string) []string {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	ordered := make([]string, 0, len(names))
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		if pconf := settings.GetProgramConfig(name); pconf != nil {
+			for _, dep := range pconf.DependsOn {
+				visit(dep)
+			}
+		}
+		if wanted[name] {
+			ordered = append(ordered, name)
+		}
+	}
+	for _, pconf := range settings.Programs {
+		if wanted[pconf.Name] {
+			visit(pconf.Name)
+		}
+	}
+	for _, name := range names { // not configured, left for caller to fail.
+		visit(name)
+	}
+	return ordered
+}
+
+// validateDepends checks that programs depend on configured programs and
+// that dependencies do not form a cycle.
+func (settings *Settings) validateDepends(errs *ConfigErrors) {
+	at := settings.Origin
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int)
+	var path []string
+	var visit func(pconf *ProgramConfig) bool
+	visit = func(pconf *ProgramConfig) bool {
+		switch marks[pconf.Name] {
+		case visiting:
+			key := fmt.Sprintf("programs[%v].depends_on", pconf.Name)
+			cycle := append(path, pconf.Name)
+			for i, name := range cycle {
+				if name == pconf.Name {
+					cycle = cycle[i:]
+					break
+				}
+			}
+			errs.add(at(key), key, "dependency cycle %v", strings.Join(cycle, " -> "))
+			return false
+		case visited:
+			return true
+		}
+		marks[pconf.Name] = visiting
+		path = append(path, pconf.Name)
+		defer func() { path = path[:len(path)-1] }()
+		for _, dep := range pconf.DependsOn {
+			if dconf := settings.GetProgramConfig(dep); dconf != nil && !visit(dconf) {
+				return false
+			}
+		}
+		marks[pconf.Name] = visited
+		return true
+	}
+
+	for i, pconf := range settings.Programs {
+		if pconf == nil || pconf.Name == "" {
+			continue
+		}
+		key := programKey(i, pconf) + ".depends_on"
+		for j, dep := range pconf.DependsOn {
+			if settings.GetProgramConfig(dep) == nil {
+				dkey := fmt.Sprintf("%v[%v]", key, j)
+				errs.add(at(dkey), dkey, "unknown program %q", dep)
+			}
+		}
+	}
+	for _, pconf := range settings.Programs {
+		if pconf != nil && pconf.Name != "" && !visit(pconf) {
+			break // one cycle is reported
+		}
+	}
+}
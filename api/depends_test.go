@@ -0,0 +1,77 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dependsSettings returns settings with programs in the order of
+// `programs`, each like "name:dep1,dep2".
+func dependsSettings(programs ...string) *Settings {
+	settings := &Settings{}
+	for _, program := range programs {
+		parts := strings.SplitN(program, ":", 2)
+		pconf := &ProgramConfig{Name: parts[0]}
+		if len(parts) > 1 && parts[1] != "" {
+			pconf.DependsOn = strings.Split(parts[1], ",")
+		}
+		settings.Programs = append(settings.Programs, pconf)
+	}
+	return settings
+}
+
+func TestStartOrder(t *testing.T) {
+	testcases := []struct {
+		programs []string
+		names    []string
+		order    []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"c", "a"}, []string{"a", "c"}},
+		{[]string{"a:b", "b:c", "c"}, []string{"a", "b", "c"}, []string{"c", "b", "a"}},
+		{[]string{"projector:indexer,indexmgr", "indexer:indexmgr", "indexmgr"},
+			[]string{"projector", "indexer", "indexmgr"},
+			[]string{"indexmgr", "indexer", "projector"}},
+		// through programs not in names.
+		{[]string{"a:b", "b:c", "c"}, []string{"a", "c"}, []string{"c", "a"}},
+		{[]string{"a:b", "b", "c"}, []string{"c", "b", "a"}, []string{"b", "a", "c"}},
+		{[]string{"a", "b"}, []string{"a", "x"}, []string{"a", "x"}},
+		{[]string{"a", "b"}, []string{}, []string{}},
+	}
+	for _, tc := range testcases {
+		order := dependsSettings(tc.programs...).StartOrder(tc.names)
+		if !reflect.DeepEqual(order, tc.order) {
+			t.Errorf("%v: StartOrder(%v) expected %v, got %v", tc.programs, tc.names, tc.order, order)
+		}
+	}
+}
+
+func TestValidateDepends(t *testing.T) {
+	testcases := []struct {
+		programs []string
+		errs     []string
+	}{
+		{[]string{"a:b", "b:c", "c"}, nil},
+		{[]string{"a:b,c", "b:c", "c"}, nil},
+		{[]string{"a:x", "b"}, []string{`programs[a].depends_on[0]: unknown program "x"`}},
+		{[]string{"a:a"}, []string{"programs[a].depends_on: dependency cycle a -> a"}},
+		{[]string{"a:b", "b:a"}, []string{"programs[a].depends_on: dependency cycle a -> b -> a"}},
+		{[]string{"c", "a:b", "b:c,d", "d:b"},
+			[]string{"programs[b].depends_on: dependency cycle b -> d -> b"}},
+		// unknown programs are reported along with one cycle.
+		{[]string{"a:b,y", "b:a", "c:d", "d:c"}, []string{
+			`programs[a].depends_on[1]: unknown program "y"`,
+			"programs[a].depends_on: dependency cycle a -> b -> a"}},
+	}
+	for _, tc := range testcases {
+		errs := make(ConfigErrors, 0)
+		dependsSettings(tc.programs...).validateDepends(&errs)
+		got := []string(nil)
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, tc.errs) {
+			t.Errorf("%v: expected errors %q, got %q", tc.programs, tc.errs, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Kinds of ProgramChange.
+const (
+	PROGRAM_ADDED   = "added"
+	PROGRAM_REMOVED = "removed"
+	PROGRAM_CHANGED = "changed"
+)
+
+// ProgramChange describes how a program's configuration differs between
+// two settings.
+type ProgramChange struct {
+	Name   string
+	Kind   string   // one of PROGRAM_ADDED, PROGRAM_REMOVED, PROGRAM_CHANGED
+	Fields []string // properties that changed, for PROGRAM_CHANGED
+}
+
+// restartFields are program properties that need a running program to be
+// restarted for the change to take effect.
+var restartFields = map[string]bool{
+	"targethost": true, "user": true, "environ": true, "command": true,
+	"commandargs": true, "ssh": true,
+}
+
+// NeedsRestart tells whether a running program must be restarted to pick up
+// the change.
+func (change *ProgramChange) NeedsRestart() bool {
+	if change.Kind != PROGRAM_CHANGED {
+		return false
+	}
+	for _, field := range change.Fields {
+		if restartFields[field] {
+			return true
+		}
+	}
+	return false
+}
+
+// launchFields are program properties that a running program reads when
+// it is launched, or restarted by its restart policy. A change to them
+// applies from the program's next launch.
+var launchFields = map[string]bool{
+	"log.color": true, "restart": true, "restart.maxretries": true,
+	"restart.backoff": true, "restart.maxbackoff": true, "depends_on": true,
+	"ready": true, "kill.signals": true, "kill.timeout": true,
+}
+
+// OnNextLaunch tells whether the change applies to a running program only
+// from its next launch, since it is not restarted for it.
+func (change *ProgramChange) OnNextLaunch() bool {
+	if change.Kind != PROGRAM_CHANGED || change.NeedsRestart() {
+		return false
+	}
+	for _, field := range change.Fields {
+		if launchFields[field] {
+			return true
+		}
+	}
+	return false
+}
+
+func (change *ProgramChange) String() string {
+	if change.Kind == PROGRAM_CHANGED {
+		return change.Name + ": changed " + strings.Join(change.Fields, ", ")
+	}
+	return change.Name + ": " + change.Kind
+}
+
+// DiffPrograms compares programs configured in `old` and `new` settings and
+// returns the programs that were added, removed or changed, in the order
+// they are configured.
+func DiffPrograms(old, new *Settings) []*ProgramChange {
+	changes := make([]*ProgramChange, 0)
+	for _, pconf := range old.Programs {
+		if new.GetProgramConfig(pconf.Name) == nil {
+			changes = append(changes, &ProgramChange{Name: pconf.Name, Kind: PROGRAM_REMOVED})
+		}
+	}
+	for _, pconf := range new.Programs {
+		oldconf := old.GetProgramConfig(pconf.Name)
+		if oldconf == nil {
+			changes = append(changes, &ProgramChange{Name: pconf.Name, Kind: PROGRAM_ADDED})
+		} else if fields := diffProgram(oldconf, pconf); len(fields) > 0 {
+			changes = append(changes, &ProgramChange{
+				Name: pconf.Name, Kind: PROGRAM_CHANGED, Fields: fields,
+			})
+		}
+	}
+	return changes
+}
+
+// diffProgram returns the json names of fields that differ between `one`
+// and `two`.
+func diffProgram(one, two *ProgramConfig) []string {
+	fields := make([]string, 0)
+	v1, v2 := reflect.ValueOf(one).Elem(), reflect.ValueOf(two).Elem()
+	for i := 0; i < v1.NumField(); i++ {
+		name := v1.Type().Field(i).Tag.Get("json")
+		if name == "" && v1.Type().Field(i).Anonymous {
+			name = "ssh"
+		} else if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(v1.Field(i).Interface(), v2.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestProgramChange(t *testing.T) {
+	testcases := []struct {
+		kind         string
+		fields       []string
+		restart      bool
+		onNextLaunch bool
+	}{
+		{PROGRAM_CHANGED, []string{"command"}, true, false},
+		{PROGRAM_CHANGED, []string{"ssh", "kill.timeout"}, true, false},
+		{PROGRAM_CHANGED, []string{"kill.timeout"}, false, true},
+		{PROGRAM_CHANGED, []string{"targetroot", "ready"}, false, true},
+		{PROGRAM_CHANGED, []string{"restart.backoff"}, false, true},
+		{PROGRAM_CHANGED, []string{"repository"}, false, false},
+		{PROGRAM_ADDED, nil, false, false},
+		{PROGRAM_REMOVED, nil, false, false},
+	}
+	for _, tc := range testcases {
+		change := &ProgramChange{Name: "a", Kind: tc.kind, Fields: tc.fields}
+		if restart := change.NeedsRestart(); restart != tc.restart {
+			t.Errorf("%v: expected NeedsRestart %v, got %v", change, tc.restart, restart)
+		}
+		if next := change.OnNextLaunch(); next != tc.onNextLaunch {
+			t.Errorf("%v: expected OnNextLaunch %v, got %v", change, tc.onNextLaunch, next)
+		}
+	}
+}
+
+func TestDiffPrograms(t *testing.T) {
+	old := &Settings{Programs: []*ProgramConfig{
+		{Name: "a", Command: "x"}, {Name: "b", KillTimeout: 10}, {Name: "c"},
+	}}
+	new := &Settings{Programs: []*ProgramConfig{
+		{Name: "b", KillTimeout: 20}, {Name: "a", Command: "y"}, {Name: "d"},
+	}}
+	expected := []string{"c: removed", "b: changed kill.timeout", "a: changed command", "d: added"}
+	changes := DiffPrograms(old, new)
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	for i, change := range changes {
+		if change.String() != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], change)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// scope is a property whose keys are visible as template variables to all
+// the values nested under it.
+type scope struct {
+	key string
+	m   map[string]interface{}
+}
+
+// expander expands templates in configuration values. Values referred by a
+// template are expanded before the template, in dependency order, and each
+// value is expanded only once.
+type expander struct {
+	context  Config
+	prov     Provenance
+	secrets  *Secrets
+	expanded map[string]string // key path -> expanded value
+	failed   map[string]bool   // key path -> expansion failed
+	stack    []string          // key paths being expanded
+	errs     ConfigErrors
+}
+
+// ExpandConfig expands every string in `config` as a text/template. A
+// template can refer to any property visible from its scope, that is, its
+// sibling properties and properties of every enclosing property up to the
+// top-level, innermost first, and to properties in `context`. Dotted paths
+// like {{.repository.target}} descend into nested properties. A property
+// referring to itself, like "GOPATH": "{{.GOPATH}}/plan", refers to the
+// property from an outer scope. {{secret "name"}} is replaced by the secret
+// value resolved from `secrets`.
+//
+// Undefined references and cyclic references are returned as ConfigErrors,
+// located using `prov`.
+func ExpandConfig(
+	context, config Config, prov Provenance, secrets *Secrets) (Config, error) {
+
+	ex := &expander{
+		context:  context,
+		prov:     prov,
+		secrets:  secrets,
+		expanded: make(map[string]string),
+		failed:   make(map[string]bool),
+		errs:     make(ConfigErrors, 0),
+	}
+	newconfig := ex.expandTerm("", map[string]interface{}(config), nil)
+	if len(ex.errs) > 0 {
+		return nil, ex.errs
+	}
+	return newconfig.(Config), nil
+}
+
+// expandTerm returns a copy of `term` with all its templates expanded,
+// `scopes` are the properties enclosing `term`, innermost last.
+func (ex *expander) expandTerm(key string, term interface{}, scopes []scope) interface{} {
+	if s, ok := term.(string); ok {
+		s, _ = ex.expandString(key, s, scopes)
+		return s
+	} else if sl, ok := term.([]interface{}); ok {
+		newsl := make([]interface{}, 0, len(sl))
+		for i, item := range sl {
+			newsl = append(newsl, ex.expandTerm(elementKey(key, i, item), item, scopes))
+		}
+		return newsl
+	} else if m, ok := asProperty(term); ok {
+		scopes = append(scopes[:len(scopes):len(scopes)], scope{key, m})
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names) // expand, and report errors, in stable order
+		newconfig := make(Config)
+		for _, name := range names {
+			newconfig[name] = ex.expandTerm(joinKey(key, name), m[name], scopes)
+		}
+		return newconfig
+	}
+	return term
+}
+
+// expandString expands template `s` at `key`, after expanding the values
+// it refers to.
+func (ex *expander) expandString(key, s string, scopes []scope) (string, bool) {
+	if value, ok := ex.expanded[key]; ok {
+		return value, true
+	} else if ex.failed[key] {
+		return s, false
+	} else if !strings.Contains(s, "{{") {
+		ex.expanded[key] = s
+		return s, true
+	}
+	for i, k := range ex.stack {
+		if k == key {
+			cycle := append(ex.stack[i:len(ex.stack):len(ex.stack)], key)
+			return ex.fail(key, s, "cyclic reference %v", strings.Join(cycle, " -> "))
+		}
+	}
+	ex.stack = append(ex.stack, key)
+	defer func() { ex.stack = ex.stack[:len(ex.stack)-1] }()
+
+	funcs := template.FuncMap{"secret": ex.secrets.Lookup}
+	t, err := template.New(key).Funcs(funcs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return ex.fail(key, s, "%v", err)
+	}
+	data := make(map[string]interface{})
+	for _, ident := range templateFields(t.Tree.Root, nil) {
+		value, err := ex.lookup(key, ident, scopes)
+		if err != nil {
+			return ex.fail(key, s, "%v", err)
+		} else if value == nil {
+			ex.failed[key] = true // already reported
+			return s, false
+		}
+		setPath(data, ident, value)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err = t.Execute(buf, data); err != nil {
+		return ex.fail(key, s, "%v", err)
+	}
+	ex.expanded[key] = buf.String()
+	return ex.expanded[key], true
+}
+
+// lookup resolves field chain `ident`, referred from `key`, and returns its
+// expanded value. A nil value without error means the referred value failed
+// to expand and is already reported.
+func (ex *expander) lookup(key string, ident []string, scopes []scope) (interface{}, error) {
+	var term interface{}
+	var termKey string
+
+	i := len(scopes) - 1
+	for ; i >= 0; i-- {
+		termKey = joinKey(scopes[i].key, ident[0])
+		if _, ok := scopes[i].m[ident[0]]; ok && termKey != key {
+			term = scopes[i].m[ident[0]]
+			break
+		}
+	}
+	if i < 0 {
+		if value, ok := ex.context[ident[0]]; ok {
+			return lookupPath(value, ident)
+		}
+		return nil, fmt.Errorf("undefined variable .%v", ident[0])
+	}
+
+	scopes = scopes[: i+1 : i+1]
+	for j, name := range ident[1:] {
+		m, ok := asProperty(term)
+		if !ok {
+			return nil, fmt.Errorf("undefined variable .%v, %v is not a property",
+				strings.Join(ident[:j+2], "."), termKey)
+		} else if _, ok := m[name]; !ok {
+			return nil, fmt.Errorf("undefined variable .%v",
+				strings.Join(ident[:j+2], "."))
+		}
+		scopes = append(scopes, scope{termKey, m})
+		term, termKey = m[name], joinKey(termKey, name)
+	}
+	if s, ok := term.(string); ok {
+		if s, ok = ex.expandString(termKey, s, scopes); !ok {
+			return nil, nil
+		}
+		return s, nil
+	}
+	nerrs := len(ex.errs)
+	if term = ex.expandTerm(termKey, term, scopes); len(ex.errs) > nerrs {
+		return nil, nil
+	}
+	return term, nil
+}
+
+func (ex *expander) fail(key, s, format string, args ...interface{}) (string, bool) {
+	origin := Origin{}
+	if origins := ex.prov.Lookup(key); len(origins) > 0 {
+		origin = origins[len(origins)-1]
+	}
+	ex.errs.add(origin, key, format, args...)
+	ex.failed[key] = true
+	return s, false
+}
+
+// lookupPath descends field chain `ident` into `value`, which is the value
+// for ident[0].
+func lookupPath(value interface{}, ident []string) (interface{}, error) {
+	for j, name := range ident[1:] {
+		m, ok := asProperty(value)
+		if !ok {
+			return nil, fmt.Errorf("undefined variable .%v",
+				strings.Join(ident[:j+2], "."))
+		} else if value, ok = m[name]; !ok {
+			return nil, fmt.Errorf("undefined variable .%v",
+				strings.Join(ident[:j+2], "."))
+		}
+	}
+	return value, nil
+}
+
+// setPath sets `value` in `data` at field chain `ident`, creating nested
+// maps as needed.
+func setPath(data map[string]interface{}, ident []string, value interface{}) {
+	for _, name := range ident[:len(ident)-1] {
+		m, ok := asProperty(data[name])
+		if !ok {
+			m = make(map[string]interface{})
+			data[name] = m
+		}
+		data = m
+	}
+	data[ident[len(ident)-1]] = value
+}
+
+// templateFields returns field chains, like [a b] for {{.a.b}}, referred by
+// a parsed template. Fields inside range and with blocks are relative to
+// their pipeline and are not returned.
+func templateFields(node parse.Node, fields [][]string) [][]string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, child := range n.Nodes {
+				fields = templateFields(child, fields)
+			}
+		}
+	case *parse.ActionNode:
+		fields = templateFields(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				fields = templateFields(cmd, fields)
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			fields = templateFields(arg, fields)
+		}
+	case *parse.ChainNode:
+		fields = templateFields(n.Node, fields)
+	case *parse.FieldNode:
+		fields = append(fields, n.Ident)
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			fields = append(fields, n.Ident[1:])
+		}
+	case *parse.IfNode:
+		fields = templateFields(n.Pipe, fields)
+		fields = templateFields(n.List, fields)
+		fields = templateFields(n.ElseList, fields)
+	case *parse.RangeNode:
+		fields = templateFields(n.Pipe, fields)
+	case *parse.WithNode:
+		fields = templateFields(n.Pipe, fields)
+	case *parse.TemplateNode:
+		fields = templateFields(n.Pipe, fields)
+	}
+	return fields
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExpandConfig(t *testing.T) {
+	testcases := []struct {
+		config string
+		key    string // dotted path of the expanded value to check
+		value  string
+	}{
+		{`{"a": "x", "b": "{{.a}}y"}`, "b", "xy"},
+		{`{"a": "{{.b}}", "b": "{{.c}}", "c": "z"}`, "a", "z"},
+		{`{"root": "/opt", "p": {"dir": "{{.root}}/p"}}`, "p.dir", "/opt/p"},
+		{`{"GOPATH": "/go", "p": {"GOPATH": "{{.GOPATH}}/plan"}}`, "p.GOPATH", "/go/plan"},
+		{`{"r": {"target": "/t"}, "cmd": "cd {{.r.target}}"}`, "cmd", "cd /t"},
+		{`{"a": "{{.HOME}}"}`, "a", "/home/u"},
+		{`{"a": "no template"}`, "a", "no template"},
+	}
+	context := Config{"HOME": "/home/u"}
+	for _, tc := range testcases {
+		config := make(Config)
+		if err := json.Unmarshal([]byte(tc.config), &config); err != nil {
+			t.Fatal(err)
+		}
+		expanded, err := ExpandConfig(context, config, nil, nil)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tc.config, err)
+			continue
+		}
+		var value interface{} = map[string]interface{}(expanded)
+		for _, name := range strings.Split(tc.key, ".") {
+			m, _ := asProperty(value)
+			value = m[name]
+		}
+		if value != tc.value {
+			t.Errorf("%v: expected %v as %q, got %q", tc.config, tc.key, tc.value, value)
+		}
+	}
+}
+
+func TestExpandConfigErrors(t *testing.T) {
+	testcases := []struct {
+		config string
+		errs   []string // key: message, in order
+	}{
+		{`{"a": "{{.b}}"}`, []string{"a: undefined variable .b"}},
+		{`{"a": "{{.r.x}}", "r": {"y": "1"}}`, []string{"a: undefined variable .r.x"}},
+		{`{"a": "{{.r.x}}", "r": "1"}`,
+			[]string{"a: undefined variable .r.x, r is not a property"}},
+		{`{"a": "{{.a}}"}`, []string{"a: undefined variable .a"}},
+		{`{"a": "{{.b}}", "b": "{{.a}}"}`,
+			[]string{"a: cyclic reference a -> b -> a"}},
+		{`{"a": "{{.b}}", "b": "{{.c}}", "c": "{{.a}}"}`,
+			[]string{"a: cyclic reference a -> b -> c -> a"}},
+		{`{"p": {"a": "{{.b}}", "b": "{{.a}}"}}`,
+			[]string{"p.a: cyclic reference p.a -> p.b -> p.a"}},
+		{`{"a": "{{.b", "c": "{{.d}}"}`, []string{
+			"a: template: a:1: unclosed action", "c: undefined variable .d"}},
+	}
+	for _, tc := range testcases {
+		config := make(Config)
+		if err := json.Unmarshal([]byte(tc.config), &config); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ExpandConfig(nil, config, nil, nil)
+		errs, ok := err.(ConfigErrors)
+		if !ok {
+			t.Errorf("%v: expected ConfigErrors, got %v", tc.config, err)
+			continue
+		}
+		got := make([]string, 0, len(errs))
+		for _, e := range errs {
+			got = append(got, e.Error())
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.errs, "\n") {
+			t.Errorf("%v: expected errors %q, got %q", tc.config, tc.errs, got)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OVERLAY_KEY is the property that specifies how its sibling properties are
+// to be overlaid on the configuration loaded so far, for example
+// {"overlay": {"commandargs": "replace", "programs": "remove"}}
+const OVERLAY_KEY = "overlay"
+
+// Strategies to overlay a property.
+const (
+	// OVERLAY_APPEND appends list elements, default for lists.
+	OVERLAY_APPEND = "append"
+	// OVERLAY_PREPEND prepends list elements.
+	OVERLAY_PREPEND = "prepend"
+	// OVERLAY_REPLACE replaces a list or a property with the new value.
+	OVERLAY_REPLACE = "replace"
+	// OVERLAY_REMOVE removes list elements by their name, or removes
+	// properties by their key. Elements to remove can either be a name
+	// or a property with "name". A value, like a string or a number,
+	// removes the property itself.
+	OVERLAY_REMOVE = "remove"
+	// OVERLAY_MERGE merges list elements having the same "name", and
+	// appends the rest. For properties, the default, merges recursively.
+	// Values, like strings or numbers, can only be replaced or removed.
+	OVERLAY_MERGE = "merge"
+)
+
+var overlayStrategies = []string{
+	OVERLAY_APPEND, OVERLAY_PREPEND, OVERLAY_REPLACE, OVERLAY_REMOVE, OVERLAY_MERGE,
+}
+
+// DefaultOverlay lists the strategy for top-level properties that are not
+// specified under OVERLAY_KEY.
+var DefaultOverlay = map[string]string{
+	"programs": OVERLAY_MERGE,
+	"hosts":    OVERLAY_MERGE,
+}
+
+// Overlay merges `sources` in order, properties from later sources override
+// the earlier ones.
+func Overlay(sources ...Config) (Config, error) {
+	var err error
+
+	if len(sources) == 0 {
+		return nil, nil
+	} else if len(sources) == 1 {
+		return sources[0], nil
+	}
+	dest := sources[0]
+	for _, source := range sources[1:] {
+		if dest, err = OverlayProperty(dest, source); err != nil {
+			return nil, err
+		}
+	}
+	return dest, nil
+}
+
+// OverlayProvenance overlays configurations like Overlay and merges the
+// provenance of each source, provs[i] being provenance of sources[i].
+func OverlayProvenance(sources []Config, provs []Provenance) (Config, Provenance, error) {
+	var err error
+
+	if len(sources) == 0 {
+		return nil, nil, nil
+	}
+	dest, prov := sources[0], provs[0].clone()
+	for i, source := range sources[1:] {
+		tr := &tracker{dest: prov, src: provs[i+1]}
+		if dest, err = overlayProperty("", dest, source, tr); err != nil {
+			if cerr, ok := err.(*ConfigError); ok {
+				if origins := provs[i+1].Lookup(cerr.Key); len(origins) > 0 {
+					cerr.Origin = origins[len(origins)-1]
+				}
+			}
+			return nil, nil, err
+		}
+	}
+	return dest, prov, nil
+}
+
+// OverlaySlice appends list `two` to list `one`.
+func OverlaySlice(one, two []interface{}) []interface{} {
+	sl := make([]interface{}, len(one)+len(two))
+	copy(sl, one)
+	copy(sl[len(one):], two)
+	return sl
+}
+
+// OverlayProperty overlays property `two` on property `one`, using the
+// strategies specified by OVERLAY_KEY in `two`.
+func OverlayProperty(one, two Config) (Config, error) {
+	return overlayProperty("", one, two, nil)
+}
+
+// StripOverlay removes OVERLAY_KEY properties, and their provenance, from
+// a configuration once it is fully overlaid.
+func StripOverlay(config Config, prov Provenance) Config {
+	return stripTerm("", map[string]interface{}(config), prov).(Config)
+}
+
+func stripTerm(key string, term interface{}, prov Provenance) interface{} {
+	if m, ok := asProperty(term); ok {
+		newconfig := make(Config)
+		for name, value := range m {
+			if name == OVERLAY_KEY {
+				(&tracker{dest: prov}).drop(joinKey(key, name))
+				delete(prov, joinKey(key, name))
+				continue
+			}
+			newconfig[name] = stripTerm(joinKey(key, name), value, prov)
+		}
+		return newconfig
+	} else if sl, ok := term.([]interface{}); ok {
+		newsl := make([]interface{}, 0, len(sl))
+		for i, item := range sl {
+			newsl = append(newsl, stripTerm(elementKey(key, i, item), item, prov))
+		}
+		return newsl
+	}
+	return term
+}
+
+func overlayProperty(key string, one, two Config, tr *tracker) (Config, error) {
+	strategies, err := getOverlayStrategies(key, two)
+	if err != nil {
+		return nil, err
+	}
+	newconfig := make(Config)
+	for name, value := range one {
+		newconfig[name] = value
+	}
+	for name, value := range two {
+		if name == OVERLAY_KEY {
+			continue
+		}
+		childKey, strategy := joinKey(key, name), strategies[name]
+		if newconfig[name] == nil {
+			if strategy != OVERLAY_REMOVE {
+				newconfig[name] = value
+				tr.move(childKey, childKey)
+			}
+			continue
+		} else if strategy == OVERLAY_REMOVE && isValue(value) {
+			delete(newconfig, name)
+			tr.drop(childKey)
+			delete(tr.destProvenance(), childKey)
+			continue
+		}
+		newconfig[name], err = overlayTerm(childKey, newconfig[name], value, strategy, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newconfig, nil
+}
+
+func overlayTerm(
+	key string, one, two interface{}, strategy string, tr *tracker) (interface{}, error) {
+
+	switch value := two.(type) {
+	case int, float32, float64, string, bool:
+		if strategy != "" && strategy != OVERLAY_REPLACE {
+			return nil, overlayError(key, "cannot %v %v", strategy, typeName(two))
+		}
+		tr.move(key, key)
+		return value, nil
+	case []interface{}:
+		if sl, ok := one.([]interface{}); ok {
+			return overlayList(key, sl, value, strategy, tr)
+		}
+		return nil, overlayError(key, "expected list, got %v", typeName(one))
+	case map[string]interface{}, Config:
+		m, ok := asProperty(one)
+		if !ok {
+			return nil, overlayError(key, "expected property, got %v", typeName(one))
+		}
+		m2, _ := asProperty(value)
+		switch strategy {
+		case "", OVERLAY_MERGE:
+			tr.set(key)
+			return overlayProperty(key, m, m2, tr)
+		case OVERLAY_REPLACE:
+			tr.drop(key)
+			tr.move(key, key)
+			return value, nil
+		case OVERLAY_REMOVE:
+			tr.set(key)
+			newconfig := make(Config)
+			for name, value := range m {
+				if _, ok := m2[name]; ok {
+					tr.drop(joinKey(key, name))
+					delete(tr.destProvenance(), joinKey(key, name))
+				} else {
+					newconfig[name] = value
+				}
+			}
+			return newconfig, nil
+		}
+		return nil, overlayError(key, "cannot %v property", strategy)
+	}
+	return nil, overlayError(key, "unknown type %T", two)
+}
+
+func overlayList(
+	key string, one, two []interface{}, strategy string, tr *tracker) ([]interface{}, error) {
+
+	var sl []interface{}
+
+	tr.set(key)
+	switch strategy {
+	case "", OVERLAY_APPEND:
+		sl = OverlaySlice(one, two)
+		for i, item := range two {
+			tr.move(elementKey(key, i, item), elementKey(key, len(one)+i, item))
+		}
+	case OVERLAY_PREPEND:
+		sl = OverlaySlice(two, one)
+		tr.relist(key, one, func(i int) int { return len(two) + i })
+		for i, item := range two {
+			tr.move(elementKey(key, i, item), elementKey(key, i, item))
+		}
+	case OVERLAY_REPLACE:
+		sl = append([]interface{}{}, two...)
+		tr.drop(key)
+		for i, item := range two {
+			tr.move(elementKey(key, i, item), elementKey(key, i, item))
+		}
+	case OVERLAY_REMOVE:
+		names := make(map[string]bool)
+		for _, item := range two {
+			if name, ok := elementName(item); ok {
+				names[name] = true
+			}
+		}
+		sl = make([]interface{}, 0, len(one))
+		indexes := make([]int, len(one))
+		for i, item := range one {
+			if name, ok := elementName(item); ok && names[name] {
+				indexes[i] = -1
+				continue
+			}
+			indexes[i] = len(sl)
+			sl = append(sl, item)
+		}
+		tr.relist(key, one, func(i int) int { return indexes[i] })
+	case OVERLAY_MERGE:
+		sl = append([]interface{}{}, one...)
+		for i, item := range two {
+			j := -1
+			if name, ok := elementName(item); ok {
+				j = indexByName(sl, name)
+			}
+			if j < 0 {
+				sl = append(sl, item)
+				tr.move(elementKey(key, i, item), elementKey(key, len(sl)-1, item))
+				continue
+			}
+			// named elements have the same key path in both.
+			elemKey := elementKey(key, j, sl[j])
+			merged, err := overlayTerm(elemKey, sl[j], item, OVERLAY_MERGE, tr)
+			if err != nil {
+				return nil, err
+			}
+			sl[j] = merged
+		}
+	default:
+		return nil, overlayError(key, "cannot %v list", strategy)
+	}
+	return sl, nil
+}
+
+// getOverlayStrategies returns strategy for properties in `config`, from its
+// OVERLAY_KEY property and DefaultOverlay.
+func getOverlayStrategies(key string, config Config) (map[string]string, error) {
+	strategies := make(map[string]string)
+	if key == "" {
+		for name, strategy := range DefaultOverlay {
+			strategies[name] = strategy
+		}
+	}
+	if config[OVERLAY_KEY] == nil {
+		return strategies, nil
+	}
+	m, ok := asProperty(config[OVERLAY_KEY])
+	if !ok {
+		return nil, overlayError(joinKey(key, OVERLAY_KEY), "expected property")
+	}
+	for name, value := range m {
+		strategy, _ := value.(string)
+		if !isOverlayStrategy(strategy) {
+			return nil, overlayError(joinKey(joinKey(key, OVERLAY_KEY), name),
+				"unknown strategy %v, expected one of %v", value, overlayStrategies)
+		}
+		strategies[name] = strategy
+	}
+	return strategies, nil
+}
+
+// overlayError locates an overlay failure by key path, origin of the key is
+// filled in by OverlayProvenance.
+func overlayError(key, format string, args ...interface{}) error {
+	return &ConfigError{Key: key, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isOverlayStrategy(strategy string) bool {
+	for _, s := range overlayStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// isValue tells whether `term` is a value, neither a list nor a property.
+func isValue(term interface{}) bool {
+	switch term.(type) {
+	case int, float32, float64, string, bool:
+		return true
+	}
+	return false
+}
+
+// elementName returns the name of a list element, which is either the
+// element itself, if it is a string, or its "name" property.
+func elementName(item interface{}) (string, bool) {
+	if s, ok := item.(string); ok {
+		return s, true
+	} else if m, ok := asProperty(item); ok {
+		name, ok := m["name"].(string)
+		return name, ok && name != ""
+	}
+	return "", false
+}
+
+func indexByName(sl []interface{}, name string) int {
+	for i, item := range sl {
+		if m, ok := asProperty(item); ok && m["name"] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// tracker remaps provenance while overlaying, `dest` is the provenance of
+// configuration overlaid so far and `src` is the provenance of the
+// configuration being overlaid on it. Methods on nil tracker are no-ops.
+type tracker struct {
+	dest, src Provenance
+}
+
+func (tr *tracker) destProvenance() Provenance {
+	if tr == nil {
+		return nil
+	}
+	return tr.dest
+}
+
+// set appends origins of `key` from src to dest.
+func (tr *tracker) set(key string) {
+	if tr != nil && len(tr.src[key]) > 0 {
+		tr.dest[key] = append(tr.dest[key], tr.src[key]...)
+	}
+}
+
+// move appends origins of `srckey`, and of all properties nested under
+// it, from src to dest under `destkey`.
+func (tr *tracker) move(srckey, destkey string) {
+	if tr == nil {
+		return
+	}
+	for key, origins := range tr.src {
+		if isNestedKey(key, srckey) || key == srckey {
+			newkey := destkey + key[len(srckey):]
+			tr.dest[newkey] = append(tr.dest[newkey], origins...)
+		}
+	}
+}
+
+// drop removes origins of all properties nested under `key` from dest.
+func (tr *tracker) drop(key string) {
+	if tr == nil {
+		return
+	}
+	for k := range tr.dest {
+		if isNestedKey(k, key) {
+			delete(tr.dest, k)
+		}
+	}
+}
+
+// relist moves origins of elements in list `key` of dest, i'th element to
+// index(i)'th position, elements with negative index are dropped.
+func (tr *tracker) relist(key string, sl []interface{}, index func(int) int) {
+	if tr == nil {
+		return
+	}
+	moved := make(Provenance)
+	for i, item := range sl {
+		oldkey := elementKey(key, i, item)
+		for k, origins := range tr.dest {
+			if k == oldkey || isNestedKey(k, oldkey) {
+				delete(tr.dest, k)
+				if j := index(i); j >= 0 {
+					moved[elementKey(key, j, item)+k[len(oldkey):]] = origins
+				}
+			}
+		}
+	}
+	for k, origins := range moved {
+		tr.dest[k] = origins
+	}
+}
+
+// isNestedKey tells whether key path `key` is nested under `parent`.
+func isNestedKey(key, parent string) bool {
+	if parent == "" {
+		return key != ""
+	}
+	return strings.HasPrefix(key, parent+".") || strings.HasPrefix(key, parent+"[")
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOverlayProperty(t *testing.T) {
+	testcases := []struct {
+		one, two string // configurations, in JSON
+		result   string // overlaid configuration, in JSON
+		err      string
+	}{
+		{`{"a": 1, "b": "x"}`, `{"b": "y", "c": true}`, `{"a": 1, "b": "y", "c": true}`, ""},
+		// lists
+		{`{"l": [1, 2]}`, `{"l": [3]}`, `{"l": [1, 2, 3]}`, ""},
+		{`{"l": [1, 2]}`, `{"overlay": {"l": "append"}, "l": [3]}`, `{"l": [1, 2, 3]}`, ""},
+		{`{"l": [1, 2]}`, `{"overlay": {"l": "prepend"}, "l": [3]}`, `{"l": [3, 1, 2]}`, ""},
+		{`{"l": [1, 2]}`, `{"overlay": {"l": "replace"}, "l": [3]}`, `{"l": [3]}`, ""},
+		{`{"l": ["a", "b", "c"]}`, `{"overlay": {"l": "remove"}, "l": ["b", "x"]}`,
+			`{"l": ["a", "c"]}`, ""},
+		{`{"l": [{"name": "a"}, {"name": "b"}]}`, `{"overlay": {"l": "remove"}, "l": ["a"]}`,
+			`{"l": [{"name": "b"}]}`, ""},
+		{`{"l": [{"name": "a", "v": 1}]}`, `{"overlay": {"l": "merge"}, "l": [{"name": "a", "v": 2}, 3]}`,
+			`{"l": [{"name": "a", "v": 2}, 3]}`, ""},
+		// programs and hosts are merged by name.
+		{`{"programs": [{"name": "a", "targethost": "h1", "commandargs": ["-x"]}, {"name": "b"}]}`,
+			`{"programs": [{"name": "a", "targethost": "h2", "commandargs": ["-y"]}, {"name": "c"}]}`,
+			`{"programs": [{"name": "a", "targethost": "h2", "commandargs": ["-x", "-y"]},
+				{"name": "b"}, {"name": "c"}]}`, ""},
+		{`{"hosts": [{"name": "h1", "ssh.port": 22}]}`, `{"hosts": [{"name": "h1", "ssh.port": 2222}]}`,
+			`{"hosts": [{"name": "h1", "ssh.port": 2222}]}`, ""},
+		{`{"programs": [{"name": "a"}, {"name": "b"}]}`,
+			`{"overlay": {"programs": "remove"}, "programs": [{"name": "a"}]}`,
+			`{"programs": [{"name": "b"}]}`, ""},
+		{`{"programs": [{"name": "a"}]}`,
+			`{"overlay": {"programs": "append"}, "programs": [{"name": "a"}]}`,
+			`{"programs": [{"name": "a"}, {"name": "a"}]}`, ""},
+		// default strategies apply only at top-level.
+		{`{"x": {"programs": [{"name": "a", "v": 1}]}}`, `{"x": {"programs": [{"name": "a", "v": 2}]}}`,
+			`{"x": {"programs": [{"name": "a", "v": 1}, {"name": "a", "v": 2}]}}`, ""},
+		// properties
+		{`{"environ": {"A": "1", "B": "2"}}`, `{"environ": {"B": "3"}}`,
+			`{"environ": {"A": "1", "B": "3"}}`, ""},
+		{`{"environ": {"A": "1", "B": "2"}}`, `{"overlay": {"environ": "replace"}, "environ": {"B": "3"}}`,
+			`{"environ": {"B": "3"}}`, ""},
+		{`{"environ": {"A": "1", "B": "2"}}`, `{"overlay": {"environ": "remove"}, "environ": {"A": ""}}`,
+			`{"environ": {"B": "2"}}`, ""},
+		{`{"environ": {"A": "1"}}`, `{"environ": {"overlay": {"A": "remove"}, "A": ""}}`,
+			`{"environ": {}}`, ""},
+		// values
+		{`{"user": "a", "b": 1}`, `{"overlay": {"user": "remove"}, "user": ""}`, `{"b": 1}`, ""},
+		{`{"b": 1}`, `{"overlay": {"user": "remove"}, "user": ""}`, `{"b": 1}`, ""},
+		{`{"user": "a"}`, `{"overlay": {"user": "replace"}, "user": "b"}`, `{"user": "b"}`, ""},
+		{`{"user": "a"}`, `{"overlay": {"user": "append"}, "user": "b"}`, "", "user: cannot append string"},
+		{`{"x": {"n": 1}}`, `{"x": {"overlay": {"n": "merge"}, "n": 2}}`, "", "x.n: cannot merge number"},
+		// errors
+		{`{"l": [1]}`, `{"l": {"a": 1}}`, "", "l: expected property, got list"},
+		{`{"l": {"a": 1}}`, `{"l": [1]}`, "", "l: expected list, got property"},
+		{`{"l": [1]}`, `{"overlay": {"l": "sort"}, "l": [2]}`, "",
+			"overlay.l: unknown strategy sort, expected one of [append prepend replace remove merge]"},
+		{`{"l": {"a": 1}}`, `{"overlay": {"l": "append"}, "l": {"b": 1}}`, "", "l: cannot append property"},
+		{`{"l": [1]}`, `{"overlay": []}`, "", "overlay: expected property"},
+	}
+	for _, tc := range testcases {
+		var one, two Config
+		if err := json.Unmarshal([]byte(tc.one), &one); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal([]byte(tc.two), &two); err != nil {
+			t.Fatal(err)
+		}
+		result, err := OverlayProperty(one, two)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%v + %v: expected error %q, got %v", tc.one, tc.two, tc.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v + %v: unexpected error %v", tc.one, tc.two, err)
+			continue
+		}
+		if got, expected := canonicalJSON(t, result), canonicalJSON(t, tc.result); got != expected {
+			t.Errorf("%v + %v: expected %v, got %v", tc.one, tc.two, expected, got)
+		}
+	}
+}
+
+// canonicalJSON returns `config`, a Config or its JSON, as compact JSON
+// with sorted keys.
+func canonicalJSON(t *testing.T, config interface{}) string {
+	if s, ok := config.(string); ok {
+		var c interface{}
+		if err := json.Unmarshal([]byte(s), &c); err != nil {
+			t.Fatal(err)
+		}
+		config = c
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestOverlayProvenance(t *testing.T) {
+	one := `{
+		"user": "a",
+		"parallelism": 2,
+		"commandargs": ["-a", "-b"],
+		"programs": [
+			{"name": "x", "targethost": "h1"},
+			{"name": "y", "targethost": "h2"}
+		]
+	}`
+	testcases := []struct {
+		two  string
+		prov string // of overlaid configuration, like key=file:line
+	}{
+		{`{
+			"user": "b",
+			"commandargs": ["-c"],
+			"programs": [
+				{"name": "y", "targethost": "h3"},
+				{"name": "z"}
+			]
+		}`, `commandargs=one:4,two:3 commandargs[0]=one:4 commandargs[1]=one:4 ` +
+			`commandargs[2]=two:3 parallelism=one:3 programs=one:5,two:4 ` +
+			`programs[x]=one:6 programs[x].name=one:6 programs[x].targethost=one:6 ` +
+			`programs[y]=one:7,two:5 programs[y].name=one:7,two:5 programs[y].targethost=one:7,two:5 ` +
+			`programs[z]=two:6 programs[z].name=two:6 user=one:2,two:2`},
+		{`{
+			"overlay": {"commandargs": "prepend", "user": "remove"},
+			"commandargs": ["-c"],
+			"user": ""
+		}`, `commandargs=one:4,two:3 commandargs[0]=two:3 commandargs[1]=one:4 ` +
+			`commandargs[2]=one:4 parallelism=one:3 programs=one:5 ` +
+			`programs[x]=one:6 programs[x].name=one:6 programs[x].targethost=one:6 ` +
+			`programs[y]=one:7 programs[y].name=one:7 programs[y].targethost=one:7`},
+		{`{
+			"overlay": {"commandargs": "remove", "programs": "remove"},
+			"commandargs": ["-a"],
+			"programs": ["x"]
+		}`, `commandargs=one:4,two:3 commandargs[0]=one:4 parallelism=one:3 ` +
+			`programs=one:5,two:4 programs[y]=one:7 programs[y].name=one:7 ` +
+			`programs[y].targethost=one:7 user=one:2`},
+		{`{
+			"overlay": {"programs": "replace"},
+			"programs": [
+				{"name": "z"}
+			]
+		}`, `commandargs=one:4 commandargs[0]=one:4 commandargs[1]=one:4 ` +
+			`parallelism=one:3 programs=one:5,two:3 programs[z]=two:4 ` +
+			`programs[z].name=two:4 user=one:2`},
+	}
+	for i, tc := range testcases {
+		c1, p1, err := decodeConfig("one", []byte(one))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, p2, err := decodeConfig("two", []byte(tc.two))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, prov, err := OverlayProvenance([]Config{c1, c2}, []Provenance{p1, p2})
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", i, err)
+			continue
+		}
+		StripOverlay(config, prov)
+		if got := describeProvenance(prov); got != tc.prov {
+			t.Errorf("%v: expected provenance\n%v\ngot\n%v", i, tc.prov, got)
+		}
+	}
+}
+
+func TestOverlayProvenanceError(t *testing.T) {
+	c1, p1, _ := decodeConfig("one", []byte(`{"user": "a"}`))
+	c2, p2, _ := decodeConfig("two", []byte("{\n\"overlay\": {\"user\": \"prepend\"},\n\"user\": \"b\"}"))
+	_, _, err := OverlayProvenance([]Config{c1, c2}, []Provenance{p1, p2})
+	if expected := "two:3: user: cannot prepend string"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+// describeProvenance returns `prov` as key=file:line,file:line sorted by
+// key.
+func describeProvenance(prov Provenance) string {
+	keys := make([]string, 0, len(prov))
+	for key := range prov {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ss := make([]string, 0, len(keys))
+	for _, key := range keys {
+		froms := make([]string, 0, len(prov[key]))
+		for _, o := range prov[key] {
+			froms = append(froms, o.String())
+		}
+		ss = append(ss, fmt.Sprintf("%v=%v", key, strings.Join(froms, ",")))
+	}
+	return strings.Join(ss, " ")
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ENV_PREFIX is the prefix for environment variables that override top-level
+// configuration properties, like CBSH_SSH_POOL_SIZE for "ssh.pool.size".
+const ENV_PREFIX = "CBSH_"
+
+// PROFILE_KEY selects one of the profiles under PROFILES_KEY, the selected
+// profile is overlaid on the configuration loaded from files.
+const PROFILE_KEY = "profile"
+const PROFILES_KEY = "profiles"
+
+// Override sets a configuration property from outside the configuration
+// files, like from environment or command line.
+type Override struct {
+	Key    string // key path of the property
+	Value  interface{}
+	Origin Origin
+	env    bool // Key is from environment, matched loosely with top-level keys
+}
+
+// ParseOverride parses `arg` in the form key=value, where key is a key path
+// like "programs[indexer].targethost". Value is parsed as JSON if possible,
+// so that numbers, booleans and lists can be set, else used as string.
+func ParseOverride(arg string) (*Override, error) {
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("Invalid override %q, expected key=value", arg)
+	}
+	key := strings.TrimSpace(parts[0])
+	return &Override{
+		Key:    key,
+		Value:  parseValue(parts[1]),
+		Origin: Origin{File: "-set"},
+	}, nil
+}
+
+// EnvOverrides returns overrides from environment variables prefixed with
+// ENV_PREFIX, `environ` is a list of key=value strings like os.Environ().
+func EnvOverrides(environ []string) []*Override {
+	overrides := make([]*Override, 0)
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], ENV_PREFIX) {
+			continue
+		}
+		name := parts[0][len(ENV_PREFIX):]
+		if name == "" || strings.HasPrefix(name, "SECRET") {
+			continue // secrets are not configuration properties
+		}
+		overrides = append(overrides, &Override{
+			Key:    strings.ToLower(strings.Replace(name, "_", ".", -1)),
+			Value:  parseValue(parts[1]),
+			Origin: Origin{File: "$" + parts[0]},
+			env:    true,
+		})
+	}
+	return overrides
+}
+
+// ProfileOverride selects profile `name`.
+func ProfileOverride(name string) *Override {
+	return &Override{
+		Key:    PROFILE_KEY,
+		Value:  name,
+		Origin: Origin{File: "-profile"},
+	}
+}
+
+// selectProfile overlays the selected profile on `config` and removes
+// PROFILES_KEY from it. Profile is selected by the last override for
+// PROFILE_KEY, if any, else by PROFILE_KEY in `config`. Profiles are
+// overlaid before OVERLAY_KEY is stripped, so a profile can specify how its
+// properties are overlaid.
+func selectProfile(
+	config Config, prov Provenance, overrides []*Override) (Config, Provenance, error) {
+
+	name, _ := config[PROFILE_KEY].(string)
+	origin := lastOrigin(prov, PROFILE_KEY)
+	for _, o := range overrides {
+		if o.Key == PROFILE_KEY {
+			if name, _ = o.Value.(string); name == "" {
+				return nil, nil, &ConfigError{o.Origin, o.Key, "expected profile name"}
+			}
+			origin = o.Origin
+		}
+	}
+	profiles, _ := asProperty(config[PROFILES_KEY])
+	newconfig := make(Config)
+	for key, value := range config {
+		if key != PROFILES_KEY {
+			newconfig[key] = value
+		}
+	}
+	newprov := prov.clone()
+	(&tracker{dest: newprov}).drop(PROFILES_KEY)
+	delete(newprov, PROFILES_KEY)
+	if name == "" {
+		return newconfig, newprov, nil
+	}
+
+	profile, ok := asProperty(profiles[name])
+	if !ok {
+		return nil, nil, &ConfigError{origin, PROFILE_KEY, fmt.Sprintf("profile %q not found", name)}
+	}
+	// provenance of profile properties, keyed relative to the profile.
+	prefix := joinKey(PROFILES_KEY, name)
+	profprov := make(Provenance)
+	for key, origins := range prov {
+		if isNestedKey(key, prefix) {
+			profprov[strings.TrimPrefix(key[len(prefix):], ".")] = origins
+		}
+	}
+	return OverlayProvenance(
+		[]Config{newconfig, profile}, []Provenance{newprov, profprov})
+}
+
+// applyOverrides sets `overrides`, in order, on `config`.
+func applyOverrides(config Config, prov Provenance, overrides []*Override) error {
+	for _, o := range overrides {
+		key := o.Key
+		if o.env {
+			key = envKey(config, key)
+		}
+		key, err := SetKey(config, key, o.Value)
+		if err != nil {
+			return &ConfigError{o.Origin, o.Key, err.Error()}
+		}
+		// overridden value replaces everything nested under it.
+		(&tracker{dest: prov}).drop(key)
+		prov[key] = append(prov[key], o.Origin)
+	}
+	return nil
+}
+
+// SetKey sets property at key path `key` in `config` and returns the key
+// path of the property as reported by WalkConfig. Like LookupKey, the longest
+// matching name is picked at each level, and the remaining key path is used
+// as a property name if nothing matches. List elements must already exist.
+// Properties and lists along the key path are copied, not modified, since
+// they can be shared with the sources of `config`.
+func SetKey(config Config, key string, value interface{}) (string, error) {
+	var term interface{} = map[string]interface{}(config)
+	m, _ := asProperty(term)
+	name, path := setName(m, key), ""
+	for name != key {
+		var err error
+		if len(key) == len(name)+1 {
+			return "", fmt.Errorf("invalid key path %v", joinKey(path, key))
+		}
+		path, key = joinKey(path, name), strings.TrimPrefix(key[len(name):], ".")
+		term = m[name]
+		if key[0] == '[' {
+			sl, ok := term.([]interface{})
+			end := strings.IndexByte(key, ']')
+			if !ok {
+				return "", fmt.Errorf("%v is not a list", path)
+			} else if end < 0 {
+				return "", fmt.Errorf("invalid key path %v%v", path, key)
+			}
+			i := indexOfElement(sl, key[1:end])
+			if i < 0 {
+				return "", fmt.Errorf("%v%v not found", path, key[:end+1])
+			}
+			sl = append([]interface{}{}, sl...)
+			m[name] = sl
+			path, key = elementKey(path, i, sl[i]), strings.TrimPrefix(key[end+1:], ".")
+			if key == "" {
+				sl[i] = value
+				return path, nil
+			}
+			if sl[i], err = copyProperty(path, sl[i]); err != nil {
+				return "", err
+			}
+			m, _ = asProperty(sl[i])
+		} else {
+			if m[name], err = copyProperty(path, term); err != nil {
+				return "", err
+			}
+			m, _ = asProperty(m[name])
+		}
+		name = setName(m, key)
+	}
+	if strings.ContainsAny(key, "[]") {
+		return "", fmt.Errorf("%v not found", joinKey(path, key))
+	}
+	m[key] = value
+	return joinKey(path, key), nil
+}
+
+// setName returns the longest name in `m` that prefixes key path `key`, or
+// `key` itself if none does.
+func setName(m map[string]interface{}, key string) string {
+	name := ""
+	for k := range m {
+		if len(k) > len(name) && (key == k ||
+			strings.HasPrefix(key, k+".") || strings.HasPrefix(key, k+"[")) {
+			name = k
+		}
+	}
+	if name == "" {
+		return key
+	}
+	return name
+}
+
+func copyProperty(key string, term interface{}) (Config, error) {
+	m, ok := asProperty(term)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a property", key)
+	}
+	newconfig := make(Config)
+	for name, value := range m {
+		newconfig[name] = value
+	}
+	return newconfig, nil
+}
+
+// indexOfElement is like lookupElement, but returns the element's index.
+func indexOfElement(sl []interface{}, id string) int {
+	if i := indexByName(sl, id); i >= 0 {
+		return i
+	}
+	if i, err := strconv.Atoi(id); err == nil && i >= 0 && i < len(sl) {
+		return i
+	}
+	return -1
+}
+
+// envKey maps the key of an environment override to a top-level key in
+// `config`, ignoring case and treating '.' and '_' alike, so that
+// CBSH_GOPATH overrides "GOPATH".
+func envKey(config Config, key string) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Replace(s, ".", "_", -1))
+	}
+	if _, ok := config[key]; ok {
+		return key
+	}
+	for name := range config {
+		if normalize(name) == normalize(key) {
+			return name
+		}
+	}
+	return key
+}
+
+func parseValue(s string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(s), &value); err == nil && value != nil {
+		return value
+	}
+	return s
+}
+
+func lastOrigin(prov Provenance, key string) Origin {
+	if origins := prov.Lookup(key); len(origins) > 0 {
+		return origins[len(origins)-1]
+	}
+	return Origin{}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseOverride(t *testing.T) {
+	testcases := []struct {
+		arg   string
+		key   string
+		value interface{}
+		err   string
+	}{
+		{"parallelism=4", "parallelism", float64(4), ""},
+		{"log.stdout=true", "log.stdout", true, ""},
+		{"programs[indexer].targethost=10.0.0.2", "programs[indexer].targethost", "10.0.0.2", ""},
+		{" user = root", "user", " root", ""},
+		{`commandargs=["-a", "b"]`, "commandargs", []interface{}{"-a", "b"}, ""},
+		{"command=a=b", "command", "a=b", ""},
+		{"environ.X=", "environ.X", "", ""},
+		{"environ.X=null", "environ.X", "null", ""},
+		{"parallelism", "", nil, `Invalid override "parallelism", expected key=value`},
+		{" =1", "", nil, `Invalid override " =1", expected key=value`},
+	}
+	for _, tc := range testcases {
+		o, err := ParseOverride(tc.arg)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%q: expected error %q, got %v", tc.arg, tc.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.arg, err)
+			continue
+		}
+		if o.Key != tc.key || !reflect.DeepEqual(o.Value, tc.value) {
+			t.Errorf("%q: expected %v=%#v, got %v=%#v", tc.arg, tc.key, tc.value, o.Key, o.Value)
+		}
+	}
+}
+
+func TestSetKey(t *testing.T) {
+	config := `{
+		"ssh.pool.size": 4,
+		"environ": {"GOPATH": "/go"},
+		"programs": [
+			{"name": "indexer", "targethost": "a", "environ": {"X": "1"}},
+			{"name": "projector", "targethost": "b"}
+		]
+	}`
+	testcases := []struct {
+		key    string
+		value  interface{}
+		setkey string // key path reported by SetKey
+		result string // resulting configuration, in JSON
+		err    string
+	}{
+		{"ssh.pool.size", 8, "ssh.pool.size", `{"ssh.pool.size": 8}`, ""},
+		{"user", "root", "user", `{"user": "root"}`, ""},
+		{"environ.GOPATH", "/gopath", "environ.GOPATH",
+			`{"environ": {"GOPATH": "/gopath"}}`, ""},
+		{"environ.a.b", "1", "environ.a.b", `{"environ": {"GOPATH": "/go", "a.b": "1"}}`, ""},
+		{"programs[indexer].targethost", "c", "programs[indexer].targethost",
+			`{"programs": [{"name": "indexer", "targethost": "c", "environ": {"X": "1"}},
+				{"name": "projector", "targethost": "b"}]}`, ""},
+		{"programs[1].environ", map[string]interface{}{"Y": "2"}, "programs[projector].environ",
+			`{"programs": [{"name": "indexer", "targethost": "a", "environ": {"X": "1"}},
+				{"name": "projector", "targethost": "b", "environ": {"Y": "2"}}]}`, ""},
+		{"programs[indexer].environ.X", "3", "programs[indexer].environ.X",
+			`{"programs": [{"name": "indexer", "targethost": "a", "environ": {"X": "3"}},
+				{"name": "projector", "targethost": "b"}]}`, ""},
+		{"programs[indexmgr].targethost", "c", "", "", "programs[indexmgr] not found"},
+		{"programs[2]", "c", "", "", "programs[2] not found"},
+		{"environ[0]", "c", "", "", "environ is not a list"},
+		{"ssh.pool.size.x", 1, "", "", "ssh.pool.size is not a property"},
+		{"user[0]", "c", "", "", "user[0] not found"},
+	}
+	for _, tc := range testcases {
+		c := make(Config)
+		if err := json.Unmarshal([]byte(config), &c); err != nil {
+			t.Fatal(err)
+		}
+		setkey, err := SetKey(c, tc.key, tc.value)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%v: expected error %q, got %v", tc.key, tc.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: unexpected error %v", tc.key, err)
+			continue
+		} else if setkey != tc.setkey {
+			t.Errorf("%v: expected key path %v, got %v", tc.key, tc.setkey, setkey)
+		}
+		expected := make(Config)
+		json.Unmarshal([]byte(config), &expected)
+		json.Unmarshal([]byte(tc.result), &expected)
+		got, _ := json.Marshal(c)
+		want, _ := json.Marshal(expected)
+		if string(got) != string(want) {
+			t.Errorf("%v: expected %s, got %s", tc.key, want, got)
+		}
+	}
+}
+
+// SetKey copies the properties and lists along the key path, leaving the
+// ones shared with the sources of configuration untouched.
+func TestSetKeyCopies(t *testing.T) {
+	program := map[string]interface{}{"name": "indexer", "targethost": "a"}
+	programs := []interface{}{program}
+	config := Config{"programs": programs}
+	if _, err := SetKey(config, "programs[indexer].targethost", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if program["targethost"] != "a" || programs[0].(map[string]interface{})["targethost"] != "a" {
+		t.Errorf("SetKey modified shared properties")
+	}
+}
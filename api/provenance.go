@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Origin locates a property in a configuration file.
+type Origin struct {
+	File string
+	Line int // 0 if line is not known
+}
+
+func (o Origin) String() string {
+	if o.Line > 0 {
+		return fmt.Sprintf("%v:%v", o.File, o.Line)
+	}
+	return o.File
+}
+
+// Provenance maps the key path of every property in a configuration to its
+// origins. The last origin is the one that finally set the property, and the
+// ones before it were overridden, or for lists, appended to.
+type Provenance map[string][]Origin
+
+// Lookup returns origins of property `key`. If `key` was not set by any
+// file, like a default value, origins of its closest parent are returned.
+func (prov Provenance) Lookup(key string) []Origin {
+	for key != "" {
+		if origins, ok := prov[key]; ok {
+			return origins
+		}
+		key = parentKey(key)
+	}
+	return nil
+}
+
+// Describe returns a human readable history of property `key`, like
+// "targethost set by indexerConfig.json:4, overridden by local.json:3".
+// Files are shown relative to `dirname`, if it is not empty.
+func (prov Provenance) Describe(key, dirname string) string {
+	origins := prov.Lookup(key)
+	if len(origins) == 0 {
+		return fmt.Sprintf("%v not set by any file", key)
+	}
+	ss := make([]string, 0, len(origins))
+	for i, o := range origins {
+		if dirname != "" {
+			if rel, err := filepath.Rel(dirname, o.File); err == nil {
+				o.File = rel
+			}
+		}
+		if i == 0 {
+			ss = append(ss, fmt.Sprintf("%v set by %v", key, o))
+		} else {
+			ss = append(ss, fmt.Sprintf("overridden by %v", o))
+		}
+	}
+	return strings.Join(ss, ", ")
+}
+
+func (prov Provenance) clone() Provenance {
+	newprov := make(Provenance)
+	for key, origins := range prov {
+		newprov[key] = append([]Origin{}, origins...)
+	}
+	return newprov
+}
+
+// parentKey returns the key path of the property containing `key`, it
+// reverses joinKey and elementKey.
+func parentKey(key string) string {
+	if strings.HasSuffix(key, "]") {
+		return key[:strings.LastIndexByte(key, '[')]
+	}
+	if i := strings.LastIndexByte(key, '.'); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// fileProvenance returns the origin of every property in json `data`, read
+// from `file`, that decoded to `config`.
+func fileProvenance(file string, data []byte, config Config) (Provenance, error) {
+	prov := make(Provenance)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	lineAt := func() int {
+		return bytes.Count(data[:dec.InputOffset()], []byte{'\n'}) + 1
+	}
+
+	var walk func(key string, term interface{}) (int, error)
+	walk = func(key string, term interface{}) (int, error) {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+		line := lineAt()
+		switch tok {
+		case json.Delim('{'):
+			m, _ := asProperty(term)
+			for dec.More() {
+				if tok, err = dec.Token(); err != nil {
+					return 0, err
+				}
+				name, _ := tok.(string)
+				childKey := joinKey(key, name)
+				prov[childKey] = []Origin{{file, lineAt()}}
+				if _, err = walk(childKey, m[name]); err != nil {
+					return 0, err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			sl, _ := term.([]interface{})
+			for i := 0; dec.More(); i++ {
+				var item interface{}
+				if i < len(sl) {
+					item = sl[i]
+				}
+				elemKey := elementKey(key, i, item)
+				elemLine, err := walk(elemKey, item)
+				if err != nil {
+					return 0, err
+				}
+				if _, ok := prov[elemKey]; !ok {
+					prov[elemKey] = []Origin{{file, elemLine}}
+				}
+			}
+			_, err = dec.Token()
+		}
+		return line, err
+	}
+	if _, err := walk("", map[string]interface{}(config)); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return prov, nil
+}
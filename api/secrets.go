@@ -0,0 +1,216 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SECRETS_KEY is the top-level property locating the secrets file, relative
+// to the configuration file, default is DefaultSecretsFile().
+const SECRETS_KEY = "secrets"
+
+// SECRET_ENV_PREFIX prefixes environment variables that supply secrets, like
+// CBSH_SECRET_GIT_PASSWORD for {{secret "git_password"}}. They take
+// precedence over the secrets file.
+const SECRET_ENV_PREFIX = "CBSH_SECRET_"
+
+// SECRETS_PASSPHRASE_ENV is the environment variable holding passphrase for
+// the secrets file.
+const SECRETS_PASSPHRASE_ENV = "CBSH_SECRETS_PASSPHRASE"
+
+// REDACTED replaces secret values in everything cbsh prints.
+const REDACTED = "******"
+
+// Secret values shorter than this are not redacted, since they would
+// mangle unrelated output.
+const minRedactLen = 4
+
+const pbkdf2Iterations = 10000
+
+// secretsFile is the encrypted on-disk format of secrets, Data is the
+// AES-GCM sealed JSON of secret name to value, with key derived from the
+// passphrase and Salt.
+type secretsFile struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// Secrets resolves secret references in configuration, from environment
+// and from an encrypted file that is decrypted on first use.
+type Secrets struct {
+	File   string
+	values map[string]string // decrypted from File
+}
+
+// NewSecrets resolves secrets from environment and from `file`.
+func NewSecrets(file string) *Secrets {
+	return &Secrets{File: file}
+}
+
+// DefaultSecretsFile is used when the configuration does not specify
+// SECRETS_KEY.
+func DefaultSecretsFile() string {
+	return path.Join(ShellDatadir(), "secrets")
+}
+
+// Lookup returns the value of secret `name` and registers the value for
+// redaction.
+func (secrets *Secrets) Lookup(name string) (string, error) {
+	if value, ok := os.LookupEnv(SecretEnv(name)); ok {
+		RegisterSecret(value)
+		return value, nil
+	}
+	if secrets == nil || secrets.File == "" {
+		return "", fmt.Errorf("secret %q not found, set %v", name, SecretEnv(name))
+	}
+	if secrets.values == nil {
+		passphrase := os.Getenv(SECRETS_PASSPHRASE_ENV)
+		if passphrase == "" {
+			return "", fmt.Errorf("secret %q: set %v to decrypt %v",
+				name, SECRETS_PASSPHRASE_ENV, secrets.File)
+		}
+		values, err := ReadSecretsFile(secrets.File, passphrase)
+		if err != nil {
+			return "", fmt.Errorf("secret %q: %v", name, err)
+		}
+		secrets.values = values
+	}
+	value, ok := secrets.values[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q not found in %v or %v",
+			name, secrets.File, SecretEnv(name))
+	}
+	RegisterSecret(value)
+	return value, nil
+}
+
+// SecretEnv returns the environment variable for secret `name`.
+func SecretEnv(name string) string {
+	env := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	return SECRET_ENV_PREFIX + strings.ToUpper(env)
+}
+
+// ReadSecretsFile decrypts secrets `file` with `passphrase`. A missing file
+// has no secrets.
+func ReadSecretsFile(file, passphrase string) (map[string]string, error) {
+	var sf secretsFile
+
+	values := make(map[string]string)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	gcm, err := secretsCipher(passphrase, sf.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, sf.Nonce, sf.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%v: wrong passphrase or corrupted file", file)
+	}
+	if err = json.Unmarshal(plain, &values); err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return values, nil
+}
+
+// WriteSecretsFile encrypts `values` with `passphrase` into `file`, readable
+// only by the user.
+func WriteSecretsFile(file, passphrase string, values map[string]string) error {
+	sf := secretsFile{Salt: make([]byte, 16)}
+	if _, err := rand.Read(sf.Salt); err != nil {
+		return err
+	}
+	gcm, err := secretsCipher(passphrase, sf.Salt)
+	if err != nil {
+		return err
+	}
+	sf.Nonce = make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(sf.Nonce); err != nil {
+		return err
+	}
+	plain, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	sf.Data = gcm.Seal(nil, sf.Nonce, plain, nil)
+	data, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
+
+func secretsCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, pbkdf2Iterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// redactor remembers every secret value resolved by this process.
+var redactor = struct {
+	sync.RWMutex
+	values []string // longest first
+}{}
+
+// RegisterSecret makes Redact hide `value`.
+func RegisterSecret(value string) {
+	if len(value) < minRedactLen {
+		return
+	}
+	redactor.Lock()
+	defer redactor.Unlock()
+	for _, v := range redactor.values {
+		if v == value {
+			return
+		}
+	}
+	redactor.values = append(redactor.values, value)
+	sort.Sort(byLength(redactor.values))
+}
+
+// Redact replaces secret values in `s`, as they are and as JSON quoted
+// strings, with REDACTED.
+func Redact(s string) string {
+	redactor.RLock()
+	defer redactor.RUnlock()
+	for _, value := range redactor.values {
+		s = strings.Replace(s, value, REDACTED, -1)
+		if data, err := json.Marshal(value); err == nil {
+			quoted := string(data[1 : len(data)-1])
+			s = strings.Replace(s, quoted, REDACTED, -1)
+		}
+	}
+	return s
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
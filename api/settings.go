@@ -0,0 +1,626 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Default values for settings that are missing in configuration.
+const (
+	DefaultSshPoolSize        = 4
+	DefaultSshPoolOverflow    = 2
+	DefaultSshPoolTimeout     = 60  // seconds
+	DefaultSshPoolIdleTimeout = 300 // seconds
+	DefaultLogMaxsize         = 10000
+	DefaultParallelism        = 8
+	DefaultRestartBackoff     = 1  // seconds
+	DefaultRestartMaxBackoff  = 60 // seconds
+	DefaultReadyTimeout       = 60 // seconds
+	DefaultReadyInterval      = 1  // seconds
+	DefaultKillTimeout        = 10 // seconds
+)
+
+// DefaultKillSignals are sent, in order, to kill a program till it stops.
+var DefaultKillSignals = []string{"TERM", "KILL"}
+
+// KillSignals lists the signals accepted by program's "kill.signals".
+var KillSignals = []string{"HUP", "INT", "QUIT", "KILL", "USR1", "USR2", "TERM"}
+
+// Restart policies for program's "restart" property, whether a program that
+// stopped on its own is started again.
+const (
+	RESTART_NEVER      = "never"
+	RESTART_ON_FAILURE = "on-failure" // exited unsuccessfully, or failed to launch
+	RESTART_ALWAYS     = "always"
+)
+
+// RestartPolicies lists the values accepted by program's "restart" property.
+var RestartPolicies = []string{RESTART_NEVER, RESTART_ON_FAILURE, RESTART_ALWAYS}
+
+// LogColors lists the values accepted by program's "log.color" property.
+var LogColors = []string{
+	"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white",
+}
+
+// Settings is the typed and validated form of a loaded configuration.
+type Settings struct {
+	File            string           `json:"-"` // top-level configuration file
+	Raw             Config           `json:"-"` // overlaid and expanded config
+	Sources         []*Source        `json:"-"` // files in the order of loading
+	Provenance      Provenance       `json:"-"` // origin of every property
+	SecretsFile     string           `json:"-"` // refer SECRETS_KEY
+	User            string           `json:"user"`
+	SshPoolSize     int              `json:"ssh.pool.size"`
+	SshPoolOverflow int              `json:"ssh.pool.overflow"`
+	SshPoolTimeout  int              `json:"ssh.pool.timeout"`     // seconds
+	SshPoolIdle     int              `json:"ssh.pool.idletimeout"` // seconds
+	LogMaxsize      int              `json:"log.maxsize"`
+	LogStdout       bool             `json:"log.stdout"`
+	LogStdoutFilter []string         `json:"log.stdout.filter"`
+	LogStderr       bool             `json:"log.stderr"`
+	LogStderrFilter []string         `json:"log.stderr.filter"`
+	Parallelism     int              `json:"parallelism"` // programs operated at a time
+	Programs        []*ProgramConfig `json:"programs"`
+	Hosts           []*HostConfig    `json:"hosts"`
+	SshConfig                        // default ssh options
+}
+
+// ProgramConfig describes a remote program, where to install it from and
+// how to launch it.
+type ProgramConfig struct {
+	Name        string              `json:"name"`
+	TargetHost  string              `json:"targethost"`
+	TargetRoot  string              `json:"targetroot"`
+	User        string              `json:"user"`
+	Environ     Environ             `json:"environ"`
+	Repository  []*RepositoryConfig `json:"repository"`
+	Command     string              `json:"command"`
+	CommandArgs []string            `json:"commandargs"`
+	LogColor    string              `json:"log.color"`
+	Restart     string              `json:"restart"` // refer RestartPolicies
+	// restarts in a row before giving up, zero for no limit.
+	RestartMaxRetries int         `json:"restart.maxretries"`
+	RestartBackoff    int         `json:"restart.backoff"`    // seconds, before first restart
+	RestartMaxBackoff int         `json:"restart.maxbackoff"` // seconds
+	DependsOn         []string    `json:"depends_on"`         // programs to be ready before
+	Ready             *ReadyProbe `json:"ready"`
+	KillSignals       []string    `json:"kill.signals"` // refer DefaultKillSignals
+	KillTimeout       int         `json:"kill.timeout"` // seconds, after each signal
+	SshConfig
+}
+
+func (pconf *ProgramConfig) setDefaults() {
+	pconf.KillTimeout = DefaultKillTimeout
+}
+
+// ReadyProbe tells when a launched program is ready for the programs that
+// depend on it, when a connection to "tcp" address succeeds, when "http"
+// url responds with status 200 or when "log" regex matches a line of its
+// output. Addresses are reached from the program's target host. Programs
+// without a probe are ready once launched.
+type ReadyProbe struct {
+	TCP      string `json:"tcp"`      // [host]:port, host defaults to localhost
+	HTTP     string `json:"http"`     // url
+	Log      string `json:"log"`      // regex
+	Timeout  int    `json:"timeout"`  // seconds to wait for the program to be ready
+	Interval int    `json:"interval"` // seconds between tcp or http probes
+}
+
+// RepositoryConfig describes a source repository to be cloned on the target
+// host and the commands to install and uninstall it.
+type RepositoryConfig struct {
+	Source    string        `json:"source"`
+	Target    string        `json:"target"`
+	Install   []InstallStep `json:"install"`
+	Uninstall []InstallStep `json:"uninstall"`
+}
+
+// InstallStep is a command to install, or uninstall, a repository. It is
+// configured either as the command string or as a property with "command"
+// and "timeout", in seconds, after which the command is cancelled.
+type InstallStep struct {
+	Command string `json:"command"`
+	Timeout int    `json:"timeout"` // zero for no timeout
+}
+
+func (step *InstallStep) decodeString(s string) {
+	step.Command = s
+}
+
+// stringDecoder is implemented by structs that can be configured as a
+// string as well.
+type stringDecoder interface {
+	decodeString(s string)
+}
+
+// defaulter is implemented by structs that set defaults of properties which
+// may be configured as zero, before they are decoded.
+type defaulter interface {
+	setDefaults()
+}
+
+// ConfigError locates an invalid configuration property by its file and key
+// path.
+type ConfigError struct {
+	Origin
+	Key string
+	Msg string
+}
+
+// Error redacts secret values from the message.
+func (e *ConfigError) Error() string {
+	if e.File == "" {
+		return Redact(fmt.Sprintf("%v: %v", e.Key, e.Msg))
+	}
+	return Redact(fmt.Sprintf("%v: %v: %v", e.Origin, e.Key, e.Msg))
+}
+
+// ConfigErrors is the list of errors found while decoding and validating a
+// configuration.
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	ss := make([]string, 0, len(errs))
+	for _, err := range errs {
+		ss = append(ss, err.Error())
+	}
+	return fmt.Sprintf("Invalid configuration:\n  %v", strings.Join(ss, "\n  "))
+}
+
+func (errs *ConfigErrors) add(origin Origin, key, format string, args ...interface{}) {
+	*errs = append(*errs, &ConfigError{origin, key, fmt.Sprintf(format, args...)})
+}
+
+// DecodeSettings decodes an overlaid and expanded configuration, loaded from
+// `file` and its include files `sources`, into typed settings and validates
+// them. On failure the returned error is of type ConfigErrors.
+func DecodeSettings(
+	config Config, prov Provenance, sources []*Source, file string) (*Settings, error) {
+
+	settings := &Settings{
+		File:            file,
+		Raw:             config,
+		Sources:         sources,
+		Provenance:      prov,
+		SshPoolSize:     DefaultSshPoolSize,
+		SshPoolOverflow: DefaultSshPoolOverflow,
+		SshPoolTimeout:  DefaultSshPoolTimeout,
+		SshPoolIdle:     DefaultSshPoolIdleTimeout,
+		LogMaxsize:      DefaultLogMaxsize,
+		Parallelism:     DefaultParallelism,
+	}
+	errs := make(ConfigErrors, 0)
+	raw, v := map[string]interface{}(config), reflect.ValueOf(settings).Elem()
+	decodeValue(settings, "", raw, v, &errs)
+	for _, pconf := range settings.Programs {
+		if pconf == nil {
+			continue
+		}
+		if pconf.User == "" {
+			pconf.User = settings.User
+		}
+		if pconf.Restart == "" {
+			pconf.Restart = RESTART_NEVER
+		}
+		if pconf.RestartBackoff == 0 {
+			pconf.RestartBackoff = DefaultRestartBackoff
+		}
+		if pconf.RestartMaxBackoff == 0 {
+			pconf.RestartMaxBackoff = DefaultRestartMaxBackoff
+			if pconf.RestartBackoff > pconf.RestartMaxBackoff {
+				pconf.RestartMaxBackoff = pconf.RestartBackoff
+			}
+		}
+		if probe := pconf.Ready; probe != nil && probe.Timeout == 0 {
+			probe.Timeout = DefaultReadyTimeout
+		}
+		if probe := pconf.Ready; probe != nil && probe.Interval == 0 {
+			probe.Interval = DefaultReadyInterval
+		}
+		if len(pconf.KillSignals) == 0 {
+			pconf.KillSignals = append([]string(nil), DefaultKillSignals...)
+		}
+	}
+	settings.registerPasswords()
+	if err := settings.Validate(); err != nil {
+		errs = append(errs, err.(ConfigErrors)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return settings, nil
+}
+
+// Validate checks settings for missing and invalid values.
+func (settings *Settings) Validate() error {
+	errs := make(ConfigErrors, 0)
+	at := settings.Origin
+	if settings.SshPoolSize < 1 {
+		errs.add(at("ssh.pool.size"), "ssh.pool.size", "should be atleast 1")
+	}
+	if settings.SshPoolOverflow < 0 {
+		errs.add(at("ssh.pool.overflow"), "ssh.pool.overflow", "should not be negative")
+	}
+	if settings.SshPoolTimeout < 1 {
+		errs.add(at("ssh.pool.timeout"), "ssh.pool.timeout", "should be atleast 1")
+	}
+	if settings.SshPoolIdle < 0 {
+		errs.add(at("ssh.pool.idletimeout"), "ssh.pool.idletimeout", "should not be negative")
+	}
+	if settings.LogMaxsize < 1 {
+		errs.add(at("log.maxsize"), "log.maxsize", "should be atleast 1")
+	}
+	if settings.Parallelism < 1 {
+		errs.add(at("parallelism"), "parallelism", "should be atleast 1")
+	}
+	settings.SshConfig.validate(settings, "", &errs)
+	hosts := make(map[string]bool)
+	for i, hconf := range settings.Hosts {
+		key := fmt.Sprintf("hosts[%v]", i)
+		if hconf == nil || hconf.Name == "" {
+			errs.add(at(key), key, "missing host name")
+			continue
+		}
+		key = fmt.Sprintf("hosts[%v]", hconf.Name)
+		if hosts[hconf.Name] {
+			errs.add(at(key+".name"), key+".name", "duplicate host %q", hconf.Name)
+		}
+		hosts[hconf.Name] = true
+		hconf.SshConfig.validate(settings, key, &errs)
+	}
+	names := make(map[string]bool)
+	for i, pconf := range settings.Programs {
+		key := programKey(i, pconf)
+		if pconf == nil {
+			errs.add(at(key), key, "empty program")
+			continue
+		}
+		if pconf.Name == "" {
+			errs.add(at(key+".name"), key+".name", "missing program name")
+		} else if names[pconf.Name] {
+			errs.add(at(key+".name"), key+".name", "duplicate program %q", pconf.Name)
+		}
+		names[pconf.Name] = true
+		if pconf.TargetHost == "" {
+			errs.add(at(key+".targethost"), key+".targethost", "missing target host")
+		}
+		if pconf.User == "" {
+			errs.add(at(key+".user"), key+".user",
+				"missing user, neither for program nor top-level")
+		}
+		if pconf.Command == "" {
+			errs.add(at(key+".command"), key+".command", "missing command")
+		}
+		if pconf.LogColor != "" && !isLogColor(pconf.LogColor) {
+			errs.add(at(key+".log.color"), key+".log.color",
+				"unknown color %q, expected one of %v", pconf.LogColor, LogColors)
+		}
+		validateRestart(settings, key, pconf, &errs)
+		validateReady(settings, key, pconf.Ready, &errs)
+		validateKill(settings, key, pconf, &errs)
+		pconf.SshConfig.validate(settings, key, &errs)
+		for j, repo := range pconf.Repository {
+			rkey := fmt.Sprintf("%v.repository[%v]", key, j)
+			if repo == nil {
+				errs.add(at(rkey), rkey, "empty repository")
+				continue
+			}
+			if repo.Source == "" {
+				errs.add(at(rkey+".source"), rkey+".source", "missing source")
+			}
+			if repo.Target == "" {
+				errs.add(at(rkey+".target"), rkey+".target", "missing target")
+			}
+			validateSteps(settings, rkey+".install", repo.Install, &errs)
+			validateSteps(settings, rkey+".uninstall", repo.Uninstall, &errs)
+		}
+	}
+	settings.validateDepends(&errs)
+	settings.validateSshPrograms(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// GetProgramConfig returns configuration for program `name`, nil if program
+// is not configured.
+func (settings *Settings) GetProgramConfig(name string) *ProgramConfig {
+	for _, pconf := range settings.Programs {
+		if pconf != nil && pconf.Name == name {
+			return pconf
+		}
+	}
+	return nil
+}
+
+// Origins returns where property `key` was set and overridden, refer
+// Provenance.Lookup.
+func (settings *Settings) Origins(key string) []Origin {
+	return settings.Provenance.Lookup(key)
+}
+
+// Origin returns the origin that finally set property `key`, or origin of
+// the top-level configuration file if `key` was not set by any file.
+func (settings *Settings) Origin(key string) Origin {
+	if origins := settings.Origins(key); len(origins) > 0 {
+		return origins[len(origins)-1]
+	}
+	return Origin{File: settings.File}
+}
+
+// ProgramNames returns the name of all configured programs, in the order of
+// configuration.
+func (settings *Settings) ProgramNames() []string {
+	names := make([]string, 0, len(settings.Programs))
+	for _, pconf := range settings.Programs {
+		names = append(names, pconf.Name)
+	}
+	return names
+}
+
+// CommandLine returns the remote command along with its arguments.
+func (pconf *ProgramConfig) CommandLine() string {
+	command := pconf.Command
+	for _, arg := range pconf.CommandArgs {
+		command += " " + arg
+	}
+	return command
+}
+
+// programKey returns the key path for i'th program, programs are identified
+// by name when available.
+func programKey(i int, pconf *ProgramConfig) string {
+	if pconf != nil && pconf.Name != "" {
+		return fmt.Sprintf("programs[%v]", pconf.Name)
+	}
+	return fmt.Sprintf("programs[%v]", i)
+}
+
+// validateRestart checks program's restart policy and its backoff.
+func validateRestart(settings *Settings, key string, pconf *ProgramConfig, errs *ConfigErrors) {
+	at := settings.Origin
+	known := false
+	for _, policy := range RestartPolicies {
+		known = known || policy == pconf.Restart
+	}
+	if pconf.Restart != "" && !known {
+		errs.add(at(key+".restart"), key+".restart",
+			"unknown policy %q, expected one of %v", pconf.Restart, RestartPolicies)
+	}
+	if pconf.RestartMaxRetries < 0 {
+		errs.add(at(key+".restart.maxretries"), key+".restart.maxretries",
+			"should not be negative")
+	}
+	if pconf.RestartBackoff < 0 {
+		errs.add(at(key+".restart.backoff"), key+".restart.backoff", "should not be negative")
+	}
+	if pconf.RestartMaxBackoff < pconf.RestartBackoff {
+		errs.add(at(key+".restart.maxbackoff"), key+".restart.maxbackoff",
+			"should be atleast restart.backoff")
+	}
+}
+
+// validateReady checks program's readiness probe, if configured.
+func validateReady(settings *Settings, key string, probe *ReadyProbe, errs *ConfigErrors) {
+	if probe == nil {
+		return
+	}
+	at, key := settings.Origin, key+".ready"
+	probes := 0
+	for _, p := range []string{probe.TCP, probe.HTTP, probe.Log} {
+		if p != "" {
+			probes++
+		}
+	}
+	if probes != 1 {
+		errs.add(at(key), key, "expected one of tcp, http or log")
+	}
+	if probe.TCP != "" {
+		if _, _, err := net.SplitHostPort(probe.TCP); err != nil {
+			errs.add(at(key+".tcp"), key+".tcp", "expected [host]:port, %v", err)
+		}
+	}
+	if probe.HTTP != "" &&
+		!strings.HasPrefix(probe.HTTP, "http://") && !strings.HasPrefix(probe.HTTP, "https://") {
+		errs.add(at(key+".http"), key+".http", "expected http or https url")
+	}
+	if probe.Log != "" {
+		if _, err := regexp.Compile(probe.Log); err != nil {
+			errs.add(at(key+".log"), key+".log", "invalid regex, %v", err)
+		}
+	}
+	if probe.Timeout < 0 {
+		errs.add(at(key+".timeout"), key+".timeout", "should not be negative")
+	}
+	if probe.Interval < 0 {
+		errs.add(at(key+".interval"), key+".interval", "should not be negative")
+	}
+}
+
+// validateKill checks the signals, and the timeout, to kill a program.
+func validateKill(settings *Settings, key string, pconf *ProgramConfig, errs *ConfigErrors) {
+	at := settings.Origin
+	for i, sig := range pconf.KillSignals {
+		if !isKillSignal(sig) {
+			skey := fmt.Sprintf("%v.kill.signals[%v]", key, i)
+			errs.add(at(skey), skey, "unknown signal %q, expected one of %v", sig, KillSignals)
+		}
+	}
+	if pconf.KillTimeout <= 0 {
+		errs.add(at(key+".kill.timeout"), key+".kill.timeout", "should be positive")
+	}
+}
+
+func isKillSignal(sig string) bool {
+	for _, s := range KillSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+func isLogColor(color string) bool {
+	for _, c := range LogColors {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeValue decodes `raw`, a value from json-decoded configuration, into
+// `v`. Struct fields are matched with properties using their json tag.
+// Type mismatches are collected in `errs` with the key path of the property.
+func decodeValue(settings *Settings, key string, raw interface{}, v reflect.Value,
+	errs *ConfigErrors) {
+
+	at := settings.Origin
+	if raw == nil {
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		if s, ok := raw.(string); ok {
+			v.SetString(s)
+		} else {
+			errs.add(at(key), key, "expected string, got %v", typeName(raw))
+		}
+	case reflect.Bool:
+		if b, ok := raw.(bool); ok {
+			v.SetBool(b)
+		} else {
+			errs.add(at(key), key, "expected boolean, got %v", typeName(raw))
+		}
+	case reflect.Int:
+		if f, ok := raw.(float64); ok && f == float64(int(f)) {
+			v.SetInt(int64(f))
+		} else {
+			errs.add(at(key), key, "expected integer, got %v", typeName(raw))
+		}
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if d, ok := elem.Interface().(defaulter); ok {
+			d.setDefaults()
+		}
+		decodeValue(settings, key, raw, elem.Elem(), errs)
+		v.Set(elem)
+	case reflect.Slice:
+		sl, ok := raw.([]interface{})
+		if !ok {
+			errs.add(at(key), key, "expected list, got %v", typeName(raw))
+			return
+		}
+		newsl := reflect.MakeSlice(v.Type(), len(sl), len(sl))
+		for i, item := range sl {
+			decodeValue(settings, elementKey(key, i, item), item, newsl.Index(i), errs)
+		}
+		v.Set(newsl)
+	case reflect.Map:
+		m, ok := asProperty(raw)
+		if !ok {
+			errs.add(at(key), key, "expected property, got %v", typeName(raw))
+			return
+		}
+		newm := reflect.MakeMap(v.Type())
+		for mkey, item := range m {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			decodeValue(settings, joinKey(key, mkey), item, elem, errs)
+			newm.SetMapIndex(reflect.ValueOf(mkey), elem)
+		}
+		v.Set(newm)
+	case reflect.Struct:
+		if s, ok := raw.(string); ok {
+			if d, ok := v.Addr().Interface().(stringDecoder); ok {
+				d.decodeString(s)
+				return
+			}
+		}
+		m, ok := asProperty(raw)
+		if !ok {
+			errs.add(at(key), key, "expected property, got %v", typeName(raw))
+			return
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := t.Field(i).Tag.Get("json")
+			if name == "" && t.Field(i).Anonymous {
+				// embedded struct shares the properties of its parent.
+				decodeValue(settings, key, raw, v.Field(i), errs)
+				continue
+			} else if name == "" || name == "-" {
+				continue
+			}
+			if item, ok := m[name]; ok {
+				decodeValue(settings, joinKey(key, name), item, v.Field(i), errs)
+			}
+		}
+	default:
+		errs.add(at(key), key, "unsupported type %v", v.Type())
+	}
+}
+
+// asProperty returns `raw` as a map of properties. Nested properties can
+// either be json-decoded maps or Config.
+func asProperty(raw interface{}) (map[string]interface{}, bool) {
+	switch m := raw.(type) {
+	case map[string]interface{}:
+		return m, true
+	case Config:
+		return m, true
+	}
+	return nil, false
+}
+
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// elementKey returns the key path for i'th element of a list, elements that
+// are properties having a "name" are identified by name.
+func elementKey(key string, i int, item interface{}) string {
+	if m, ok := asProperty(item); ok {
+		if name, ok := m["name"].(string); ok && name != "" {
+			return fmt.Sprintf("%v[%v]", key, name)
+		}
+	}
+	return fmt.Sprintf("%v[%v]", key, i)
+}
+
+// validateSteps validates install or uninstall `steps` of a repository,
+// at `key`, adding errors to `errs`.
+func validateSteps(settings *Settings, key string, steps []InstallStep, errs *ConfigErrors) {
+	at := settings.Origin
+	for i, step := range steps {
+		skey := fmt.Sprintf("%v[%v]", key, i)
+		if step.Command == "" {
+			errs.add(at(skey), skey, "missing command")
+		}
+		if step.Timeout < 0 {
+			errs.add(at(skey+".timeout"), skey+".timeout", "should not be negative")
+		}
+	}
+}
+
+func typeName(raw interface{}) string {
+	switch raw.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}, Config:
+		return "property"
+	}
+	return fmt.Sprintf("%T", raw)
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"path"
+	"reflect"
+	"strings"
+)
+
+// Default values for ssh options that are missing in configuration.
+const (
+	DefaultSshPort             = 22
+	DefaultSshHostKeyCheck     = SSH_HOSTKEY_TOFU
+	DefaultSshConnectTimeout   = 10 // seconds
+	DefaultSshHandshakeTimeout = 10 // seconds
+	DefaultSshKeepAlive        = 30 // seconds
+)
+
+// Values for "ssh.hostkeycheck" option.
+const (
+	// SSH_HOSTKEY_STRICT refuses hosts that are not in known_hosts.
+	SSH_HOSTKEY_STRICT = "strict"
+	// SSH_HOSTKEY_TOFU trusts a host on first use and adds its key to
+	// known_hosts, a changed key is refused like with strict.
+	SSH_HOSTKEY_TOFU = "tofu"
+)
+
+// SshConfig are options to log into a host. They can be specified at
+// top-level, for a host under "hosts" and for a program, in the order of
+// precedence.
+type SshConfig struct {
+	Port         int    `json:"ssh.port"`
+	IdentityFile string `json:"ssh.identityfile"` // private key file
+	Passphrase   string `json:"ssh.passphrase"`   // for encrypted IdentityFile
+	Password     string `json:"ssh.password"`
+	JumpHost     string `json:"ssh.jumphost"`     // as [user@]host[:port]
+	KnownHosts   string `json:"ssh.knownhosts"`   // default ~/.ssh/known_hosts
+	HostKeyCheck string `json:"ssh.hostkeycheck"` // strict or tofu
+	// timeouts and keepalive interval in seconds, a negative keepalive
+	// disables keepalives.
+	ConnectTimeout   int `json:"ssh.timeout.connect"`
+	HandshakeTimeout int `json:"ssh.timeout.handshake"`
+	KeepAlive        int `json:"ssh.keepalive"`
+}
+
+// HostConfig are ssh options for a host, identified by name.
+type HostConfig struct {
+	Name string `json:"name"`
+	SshConfig
+}
+
+// SshConfigFor returns ssh options to log into `host` as `user`. Top-level
+// options are overridden by options for `host` and then by options of the
+// programs that target `host` as `user`, which share their connections and
+// can not set an option differently, refer validateSshPrograms. Missing
+// options are filled with their defaults and files are resolved.
+func (settings *Settings) SshConfigFor(host, user string) *SshConfig {
+	sc := settings.SshConfig
+	for _, hconf := range settings.Hosts {
+		if hconf != nil && hconf.Name == host {
+			sc = sc.overlay(hconf.SshConfig)
+			break
+		}
+	}
+	for _, pconf := range settings.Programs {
+		if pconf != nil && pconf.TargetHost == host && pconf.User == user {
+			sc = sc.overlay(pconf.SshConfig)
+		}
+	}
+	if sc.Port == 0 {
+		sc.Port = DefaultSshPort
+	}
+	if sc.HostKeyCheck == "" {
+		sc.HostKeyCheck = DefaultSshHostKeyCheck
+	}
+	if sc.ConnectTimeout == 0 {
+		sc.ConnectTimeout = DefaultSshConnectTimeout
+	}
+	if sc.HandshakeTimeout == 0 {
+		sc.HandshakeTimeout = DefaultSshHandshakeTimeout
+	}
+	if sc.KeepAlive == 0 {
+		sc.KeepAlive = DefaultSshKeepAlive
+	}
+	if sc.KnownHosts == "" {
+		sc.KnownHosts = path.Join(HomeDir(), ".ssh", "known_hosts")
+	}
+	sc.KnownHosts = settings.resolvePath(sc.KnownHosts)
+	if sc.IdentityFile != "" {
+		sc.IdentityFile = settings.resolvePath(sc.IdentityFile)
+	}
+	return &sc
+}
+
+// overlay returns `sc` with options set in `other` overriding its own.
+func (sc SshConfig) overlay(other SshConfig) SshConfig {
+	v, o := reflect.ValueOf(&sc).Elem(), reflect.ValueOf(other)
+	for i := 0; i < v.NumField(); i++ {
+		if f := o.Field(i); f.Interface() != reflect.Zero(f.Type()).Interface() {
+			v.Field(i).Set(f)
+		}
+	}
+	return sc
+}
+
+// validate adds errors for invalid options in `sc`, specified at key
+// path `key`.
+func (sc *SshConfig) validate(settings *Settings, key string, errs *ConfigErrors) {
+	at := settings.Origin
+	if sc.Port < 0 || sc.Port > 65535 {
+		errs.add(at(joinKey(key, "ssh.port")), joinKey(key, "ssh.port"),
+			"invalid port %v", sc.Port)
+	}
+	if sc.ConnectTimeout < 0 {
+		errs.add(at(joinKey(key, "ssh.timeout.connect")), joinKey(key, "ssh.timeout.connect"),
+			"should not be negative")
+	}
+	if sc.HandshakeTimeout < 0 {
+		errs.add(at(joinKey(key, "ssh.timeout.handshake")), joinKey(key, "ssh.timeout.handshake"),
+			"should not be negative")
+	}
+	switch sc.HostKeyCheck {
+	case "", SSH_HOSTKEY_STRICT, SSH_HOSTKEY_TOFU:
+	default:
+		errs.add(at(joinKey(key, "ssh.hostkeycheck")), joinKey(key, "ssh.hostkeycheck"),
+			"unknown value %q, expected %v or %v",
+			sc.HostKeyCheck, SSH_HOSTKEY_STRICT, SSH_HOSTKEY_TOFU)
+	}
+}
+
+// validateSshPrograms adds errors for programs that target the same host as
+// the same user, and so share their ssh connections, but set an ssh option
+// differently.
+func (settings *Settings) validateSshPrograms(errs *ConfigErrors) {
+	type option struct {
+		value interface{}
+		key   string // where the option was first set
+	}
+	at := settings.Origin
+	options := make(map[string]map[string]option) // user@host -> option
+	for i, pconf := range settings.Programs {
+		if pconf == nil {
+			continue
+		}
+		login := pconf.User + "@" + pconf.TargetHost
+		if options[login] == nil {
+			options[login] = make(map[string]option)
+		}
+		key := programKey(i, pconf)
+		v, t := reflect.ValueOf(pconf.SshConfig), reflect.TypeOf(pconf.SshConfig)
+		for j := 0; j < v.NumField(); j++ {
+			f := v.Field(j)
+			if f.Interface() == reflect.Zero(f.Type()).Interface() {
+				continue
+			}
+			name := t.Field(j).Tag.Get("json")
+			okey := joinKey(key, name)
+			if first, ok := options[login][name]; !ok {
+				options[login][name] = option{value: f.Interface(), key: okey}
+			} else if first.value != f.Interface() {
+				errs.add(at(okey), okey,
+					"differs from %v, programs on %v share ssh connections", first.key, login)
+			}
+		}
+	}
+}
+
+// registerPasswords redacts ssh passwords and passphrases, even if they are
+// not referred as secrets.
+func (settings *Settings) registerPasswords() {
+	scs := []SshConfig{settings.SshConfig}
+	for _, hconf := range settings.Hosts {
+		if hconf != nil {
+			scs = append(scs, hconf.SshConfig)
+		}
+	}
+	for _, pconf := range settings.Programs {
+		if pconf != nil {
+			scs = append(scs, pconf.SshConfig)
+		}
+	}
+	for _, sc := range scs {
+		RegisterSecret(sc.Password)
+		RegisterSecret(sc.Passphrase)
+	}
+}
+
+// resolvePath expands "~/" in `file` to home directory and resolves
+// relative paths with directory of the configuration file.
+func (settings *Settings) resolvePath(file string) string {
+	if strings.HasPrefix(file, "~/") {
+		return path.Join(HomeDir(), file[2:])
+	} else if settings.File != "" {
+		return ResolveFile(file, path.Dir(settings.File))
+	}
+	return file
+}
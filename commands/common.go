@@ -1,7 +1,14 @@
 package commands
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"github.com/couchbaselabs/cbsh/sshc"
+	"text/tabwriter"
+	"time"
 )
 
 var knownCommands = map[string]api.CommandHandler{}
@@ -9,3 +16,46 @@ var knownCommands = map[string]api.CommandHandler{}
 func Allcommands() map[string]api.CommandHandler {
 	return knownCommands
 }
+
+// parallelFlag adds -p flag, the number of programs operated at a time,
+// to `fl`. Zero defaults to "parallelism" from configuration.
+func parallelFlag(fl *flag.FlagSet, parallelism *int) {
+	fl.IntVar(parallelism, "p", 0,
+		"number of programs to operate in parallel")
+}
+
+// fanoutPrograms applies `op` on `programs` in parallel and prints a summary
+// of the programs that succeeded and failed to `what`, like "install".
+func fanoutPrograms(
+	idx *shells.Indexsh, c *api.Context, what string, programs []string,
+	parallelism int, op sshc.FanoutOp) error {
+
+	if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	} else if parallelism == 0 {
+		parallelism = idx.Fabric.Config.Parallelism
+	} else if parallelism < 0 {
+		return fmt.Errorf("-p should not be negative")
+	}
+	results := idx.Fabric.Fanout(c.Ctx(), programs, parallelism, idx.Printch, op)
+
+	failed := 0
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, res := range results {
+		took := res.Duration.Round(time.Millisecond)
+		if res.Err != nil {
+			failed++
+			fmt.Fprintf(w, "  %v\tfailed\t%v\t%v\n", res.Program, took, res.Err)
+		} else {
+			fmt.Fprintf(w, "  %v\tok\t%v\t\n", res.Program, took)
+		}
+	}
+	w.Flush()
+	idx.Printch <- fmt.Sprintf("** %v summary\n%v", what, buf.String())
+	idx.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%v of %v failed to %v", failed, len(results), what)
+	}
+	return nil
+}
@@ -1,22 +1,102 @@
 package commands
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
 	"github.com/couchbaselabs/cbsh/shells"
 	"github.com/couchbaselabs/cbsh/sshc"
-	"os"
+	"path/filepath"
+	"strings"
 )
 
 var configDescription = `Choose a configuration file for secondary index`
 var configHelp = `
-    config <config-file-in-json-format>
+    config [-profile name] [-set key=value]... <config-file>
+    config show [-profile name] [-set key=value]... [config-file]
+    config check [-profile name] [-set key=value]... [config-file]
+    config reload [-profile name] [-set key=value]...
+
+Configuration files are decoded by their extension, ".json" as JSON, ".jsonc"
+as JSON with comments and trailing commas, ".yaml" or ".yml" as YAML and
+".toml" as TOML, and can include files of any format. Files with any other
+extension are decoded as JSON.
 
 "config" command will only load the configuration file. Use "run" command to
 launch the cluster. Any previous configuration that is executing in the
-cluster will be killed before loading the new configuration.
+cluster will be killed before loading the new configuration. An invalid
+configuration is reported and not loaded.
+
+Properties loaded from configuration files can be overridden, in the order of
+precedence,
+  - by a profile, selected with -profile or with "profile" property, from
+    the "profiles" property of the configuration. A profile is overlaid on
+    the configuration just like an include file.
+  - by environment variables prefixed with CBSH_, for top-level properties,
+    for example CBSH_SSH_POOL_SIZE=8 sets "ssh.pool.size" and CBSH_PROFILE
+    selects a profile.
+  - by -set key=value, where key is a key path as shown by "config show",
+    for example -set programs[indexer].targethost=10.0.0.2. Value is parsed
+    as JSON if possible, else taken as string. -set can be repeated.
+Overrides are applied before expanding templates, so templates see the
+overridden values. -profile and -set are remembered for the loaded
+configuration.
+
+Hosts are logged into using ssh-agent, "ssh.identityfile" (decrypted with
+"ssh.passphrase") or "ssh.password", in that order. Other ssh options are
+"ssh.port", "ssh.jumphost" as [user@]host and "ssh.knownhosts", and
+"ssh.hostkeycheck" which is "tofu" to trust and remember a host on first use,
+or "strict" to refuse hosts missing in known_hosts. A host in known_hosts
+is only accepted with the types of keys remembered for it. ssh options can
+be set at top-level, for a host as {"hosts": [{"name": "host", ...}]} and
+for a program, in the order of precedence. Programs targeting the same host
+as the same user share ssh connections, refer "help pools", and can not set
+an option differently. Keep passwords as {{secret "name"}}.
+
+"ssh.timeout.connect" and "ssh.timeout.handshake" are timeouts, in seconds,
+to establish a connection, default 10. "ssh.keepalive" is the interval, in
+seconds, to check a connection, default 30, connections not responding
+within the interval are closed, a negative value disables keepalives.
+
+"config show" prints every property of the overlaid and expanded
+configuration along with the file and line that set it. When a property is
+set by more than one file, all of them are listed and the last one wins. If
+[config-file] is not supplied, show the currently loaded configuration.
+
+"config check" loads [config-file], or re-loads current configuration file,
+validates it and resolves all its templates without touching the cluster.
+
+"config reload" re-loads current configuration file and lists the programs
+that were added, removed or changed. Running programs whose host, user,
+environ, command or ssh options changed are restarted, in the order of
+their "depends_on" like "run", and removed programs are killed, rest of the
+cluster, along with its ssh connections, is left running. Added programs
+are not started. Running programs that are not restarted keep the
+configuration they were launched with, their changed "restart",
+"depends_on", "ready", "kill" or "log.color" options apply from their next
+launch, listed as "(from next launch)".
 `
 
+// overrideOptions override configuration properties loaded from files, they
+// are shared by commands that load a configuration file.
+type overrideOptions struct {
+	profile string
+	sets    setFlags
+}
+
+// setFlags collects repeated -set flags.
+type setFlags []string
+
+func (sets *setFlags) String() string {
+	return strings.Join(*sets, " ")
+}
+
+func (sets *setFlags) Set(value string) error {
+	*sets = append(*sets, value)
+	return nil
+}
+
 type ConfigCommand struct{}
 
 func (cmd *ConfigCommand) Name() string {
@@ -41,32 +121,212 @@ func (cmd *ConfigCommand) Complete(c *api.Context, cursor int) []string {
 
 func (cmd *ConfigCommand) Interpret(c *api.Context) (err error) {
 	parts := api.SplitArgs(c.Line, " ")
-	if len(parts) < 2 {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if len(parts) < 2 {
+		return fmt.Errorf("Specify a configuration file")
+	}
+
+	subcmd, args := "", parts[1:]
+	if parts[1] == "show" || parts[1] == "check" || parts[1] == "reload" {
+		subcmd, args = parts[1], parts[2:]
+	}
+	options := overrideOptions{}
+	fl, err := cmd.argParse(&options, args)
+	if err != nil {
+		return
+	}
+	overrides, err := options.overrides()
+	if err != nil {
+		return
+	}
+	switch {
+	case subcmd == "show":
+		err = configShow(idx, c, fl.Args(), overrides)
+	case subcmd == "check":
+		err = configCheck(idx, c, fl.Args(), overrides)
+	case subcmd == "reload":
+		err = configReload(idx, c, overrides)
+	case fl.NArg() < 1:
 		err = fmt.Errorf("Specify a configuration file")
-	} else if idx, ok := c.Cursh.(*shells.Indexsh); ok {
-		filename := parts[1]
-		err = configForIndex(idx, c, filename)
+	default:
+		err = configForIndex(idx, c, fl.Arg(0), overrides)
 	}
 	return
 }
 
-func configForIndex(idx *shells.Indexsh, c *api.Context, fname string) (err error) {
-	idx.ConfigFile = fname
-	context := getContext()
-	if idx.Config, err = api.LoadConfig(context, fname, ""); err == nil {
+func (cmd *ConfigCommand) argParse(
+	options *overrideOptions, args []string) (*flag.FlagSet, error) {
+
+	fl := flag.NewFlagSet("config", flag.ContinueOnError)
+	options.flags(fl)
+	return fl, fl.Parse(args)
+}
+
+// flags adds -profile and -set flags to `fl`.
+func (options *overrideOptions) flags(fl *flag.FlagSet) {
+	fl.StringVar(&options.profile, "profile", "",
+		"select a profile from configuration")
+	fl.Var(&options.sets, "set",
+		"override a configuration property, as key=value")
+}
+
+func (options *overrideOptions) isEmpty() bool {
+	return options.profile == "" && len(options.sets) == 0
+}
+
+// overrides returns -profile and -set overrides, in that order.
+func (options *overrideOptions) overrides() ([]*api.Override, error) {
+	overrides := make([]*api.Override, 0)
+	if options.profile != "" {
+		overrides = append(overrides, api.ProfileOverride(options.profile))
+	}
+	for _, arg := range options.sets {
+		o, err := api.ParseOverride(arg)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+// configForIndex loads and validates configuration from `fname`, fabric is
+// restarted only if the new configuration is valid.
+func configForIndex(idx *shells.Indexsh, c *api.Context,
+	fname string, overrides []*api.Override) (err error) {
+
+	if err = idx.LoadConfig(fname, overrides); err == nil {
 		fmt.Fprintf(c.W, "Loaded config %q ...\n", idx.ConfigFile)
-		if idx.Fabric != nil {
-			idx.Fabric.Close()
+	}
+	return
+}
+
+// configShow prints overlaid and expanded configuration, one property per
+// line, along with the file that set the property.
+func configShow(idx *shells.Indexsh, c *api.Context,
+	args []string, overrides []*api.Override) (err error) {
+
+	var config *api.Settings
+
+	switch {
+	case len(args) > 0:
+		if config, err = shells.LoadSettings(args[0], overrides); err != nil {
+			return
+		}
+	case idx.Config != nil && len(overrides) == 0:
+		config = idx.Config
+	case idx.Config != nil:
+		overrides = reloadOverrides(idx, overrides)
+		if config, err = shells.LoadSettings(idx.ConfigFile, overrides); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("Configuration file not loaded")
+	}
+
+	dirname := filepath.Dir(config.File)
+	keys, values, origins := []string{}, []string{}, []string{}
+	width := 0
+	api.WalkConfig(config.Raw, func(key string, value interface{}) {
+		data, _ := json.Marshal(value)
+		ss := []string{}
+		for _, origin := range config.Origins(key) {
+			if rel, err := filepath.Rel(dirname, origin.File); err == nil {
+				origin.File = rel
+			}
+			ss = append(ss, origin.String())
 		}
-		idx.Fabric, err = sshc.StartFabric(idx.Config)
+		keys, values = append(keys, key), append(values, api.Redact(string(data)))
+		origins = append(origins, strings.Join(ss, " -> "))
+		if len(key) > width {
+			width = len(key)
+		}
+	})
+	fmt.Fprintf(c.W, "%v\n", config.File)
+	for i, key := range keys {
+		fmt.Fprintf(c.W, "  %-*v = %v  %v\n", width, key, values[i],
+			api.Cyan("("+origins[i]+")"))
 	}
 	return
 }
 
-func getContext() api.Config {
-	return map[string]interface{}{
-		"HOME": os.Getenv("HOME"),
+// configCheck loads, validates and expands configuration without starting
+// the fabric.
+func configCheck(idx *shells.Indexsh, c *api.Context,
+	args []string, overrides []*api.Override) (err error) {
+
+	var config *api.Settings
+
+	fname := idx.ConfigFile
+	if len(args) > 0 {
+		fname = args[0]
+	} else {
+		overrides = reloadOverrides(idx, overrides)
+	}
+	if fname == "" {
+		return fmt.Errorf("Specify a configuration file")
 	}
+	if config, err = shells.LoadSettings(fname, overrides); err != nil {
+		return
+	}
+	fmt.Fprintf(c.W, "Config %q is valid, programs: %v\n",
+		config.File, strings.Join(config.ProgramNames(), ", "))
+	return
+}
+
+// configReload re-loads current configuration file and restarts only the
+// programs affected by the change.
+func configReload(idx *shells.Indexsh, c *api.Context, overrides []*api.Override) (err error) {
+	var config *api.Settings
+
+	if idx.Config == nil {
+		return fmt.Errorf("Configuration file not loaded")
+	}
+	overrides = reloadOverrides(idx, overrides)
+	if config, err = shells.LoadSettings(idx.ConfigFile, overrides); err != nil {
+		return
+	}
+	changes := api.DiffPrograms(idx.Config, config)
+	started := make(map[string]bool)
+	if idx.Fabric != nil {
+		for _, change := range changes {
+			started[change.Name] = idx.Fabric.GetProgram(change.Name) != nil
+		}
+		err = idx.Fabric.Reload(c.Ctx(), config, changes, idx.Printch)
+		if err != nil && idx.Fabric.Config != config { // not switched
+			return
+		}
+	} else if idx.Fabric, err = sshc.StartFabric(config); err != nil {
+		return
+	}
+	idx.Config, idx.Overrides = config, overrides
+
+	fmt.Fprintf(c.W, "Reloaded config %q ...\n", idx.ConfigFile)
+	if len(changes) == 0 {
+		fmt.Fprintf(c.W, "  no programs changed\n")
+	}
+	for _, change := range changes {
+		switch {
+		case change.Kind == api.PROGRAM_REMOVED && started[change.Name]:
+			fmt.Fprintf(c.W, "  %v (killed)\n", change)
+		case change.NeedsRestart() && started[change.Name]:
+			fmt.Fprintf(c.W, "  %v (restarted)\n", change)
+		case change.OnNextLaunch() && started[change.Name]:
+			fmt.Fprintf(c.W, "  %v (from next launch)\n", change)
+		default:
+			fmt.Fprintf(c.W, "  %v\n", change)
+		}
+	}
+	return
+}
+
+// reloadOverrides returns overrides of the loaded configuration followed by
+// `overrides`.
+func reloadOverrides(idx *shells.Indexsh, overrides []*api.Override) []*api.Override {
+	n := len(idx.Overrides)
+	return append(idx.Overrides[:n:n], overrides...)
 }
 
 func init() {
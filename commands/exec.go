@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"strings"
+)
+
+const execDescription = `Execute a command on hosts of the cluster`
+const execHelp = `
+    exec [-p n] <host|program|all> <command>
+
+execute 'command', rest of the line, on the target host of a program, as
+its user and with its environ, on a host as [user@]host, user defaults to
+top-level "user" of configuration, or on all hosts of configured programs,
+once for every user@host. Output is prefixed with program or host name and
+every failed command reports its exit status, followed by a summary.
+
+commands are executed in parallel, upto -p at a time, refer to "help
+install". ';' separates cbsh commands, use '&&' to chain remote commands.
+ctrl-C cancels the commands.
+`
+
+type ExecCommand struct{}
+
+// execTarget is where a command is executed.
+type execTarget struct {
+	host    string
+	user    string
+	environ api.Environ
+}
+
+func (cmd *ExecCommand) Name() string {
+	return "exec"
+}
+
+func (cmd *ExecCommand) Description() string {
+	return execDescription
+}
+
+func (cmd *ExecCommand) Help() string {
+	return execHelp
+}
+
+func (cmd *ExecCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *ExecCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *ExecCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	parallelism := 0
+	fl := flag.NewFlagSet("exec", flag.ContinueOnError)
+	parallelFlag(fl, &parallelism)
+	if err = fl.Parse(args[1:]); err != nil {
+		return
+	} else if fl.NArg() < 2 {
+		return fmt.Errorf("Specify host, program or all, and the command")
+	}
+	names, targets, err := execTargets(idx, fl.Arg(0), true)
+	if err != nil {
+		return
+	}
+	command := strings.Join(fl.Args()[1:], " ")
+	return fanoutPrograms(idx, c, "exec", names, parallelism,
+		func(ctx context.Context, name string, printch chan<- string) error {
+			t := targets[name]
+			res, err := idx.Fabric.Exec(ctx, t.host, t.user, t.environ, command, printch)
+			if err != nil {
+				return err
+			}
+			return res.Err()
+		})
+}
+
+// execTargets resolves `target`, a program, [user@]host or, if `all` is
+// allowed, every user@host of configured programs. Targets are named by
+// program or host.
+func execTargets(
+	idx *shells.Indexsh, target string,
+	all bool) (names []string, targets map[string]*execTarget, err error) {
+
+	settings := idx.Fabric.Config
+	targets = make(map[string]*execTarget)
+	if pconf := settings.GetProgramConfig(target); pconf != nil {
+		targets[target] = &execTarget{pconf.TargetHost, pconf.User, pconf.Environ}
+		return []string{target}, targets, nil
+
+	} else if target == "all" && all {
+		seen := make(map[string]bool)
+		for _, pconf := range settings.Programs {
+			key := pconf.User + "@" + pconf.TargetHost
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			name := pconf.TargetHost
+			if _, ok := targets[name]; ok { // same host as another user
+				name = key
+			}
+			names = append(names, name)
+			targets[name] = &execTarget{host: pconf.TargetHost, user: pconf.User}
+		}
+		if len(names) == 0 {
+			return nil, nil, fmt.Errorf("No programs configured")
+		}
+		return names, targets, nil
+	}
+
+	user, host := settings.User, target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		user, host = target[:i], target[i+1:]
+	}
+	if user == "" || host == "" {
+		return nil, nil, fmt.Errorf("Specify user for %q as user@host", target)
+	}
+	targets[target] = &execTarget{host: host, user: user}
+	return []string{target}, targets, nil
+}
+
+func init() {
+	knownCommands["exec"] = &ExecCommand{}
+}
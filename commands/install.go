@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
@@ -9,20 +10,35 @@ import (
 
 const installDescription = `Install remote program`
 const installHelp = `
-    install -f <programnames>
+    install [-f] [-p n] <programnames>
 
 install one or more programs, typically this involved, cloning the repository
 patching it with un-commited changes from the source repository and compiling
 relevant portions of target repository. Refer to configuration spec. for more
 details. 'programnames' can be a single program name or list of program names
 separated by white-space.
+
+programs are installed in parallel, upto -p of them at a time, which defaults
+to "parallelism" from configuration, default 8, the same for programs
+uninstalled or launched at a time. Output of every program is prefixed
+with its name, followed by a summary of programs that were installed and
+that failed.
+
+"install" and "uninstall" steps of a repository are commands, or objects
+like {"command": "make", "timeout": 600} to cancel the step if it does not
+complete within "timeout" seconds. Steps without timeout run till done or
+till cancelled.
+
+ctrl-C cancels the install, the step in progress is sent SIGTERM followed by
+SIGKILL if it does not exit within few seconds.
 `
 
 type InstallCommand struct{}
 
 type installOptions struct {
-	force    bool
-	programs []string
+	force       bool
+	parallelism int
+	programs    []string
 }
 
 func (cmd *InstallCommand) Name() string {
@@ -64,6 +80,7 @@ func (cmd *InstallCommand) argParse(options *installOptions, args []string) *fla
 	fl := flag.NewFlagSet("install", flag.ContinueOnError)
 	fl.BoolVar(&options.force, "f", false,
 		"force install programs")
+	parallelFlag(fl, &options.parallelism)
 	fl.Parse(args)
 	return fl
 }
@@ -71,20 +88,27 @@ func (cmd *InstallCommand) argParse(options *installOptions, args []string) *fla
 func installForIndex(
 	idx *shells.Indexsh, options *installOptions, c *api.Context) (err error) {
 
-	for _, progname := range options.programs {
-		idx.Printch <- fmt.Sprintf("** Installing %v ...\n", progname)
-		host := idx.Fabric.Config.TargetHost(progname)
-		dir := idx.Fabric.Config.TargetRoot(progname)
-		user := idx.Fabric.Config.User(progname)
-		if dir != "" {
-			err = idx.Fabric.MakeRemoteDirs(host, user, dir, idx.Printch)
-		}
-		if err != nil {
-			return
-		}
-		err = idx.Fabric.InstallProgram(progname, idx.Printch, options.force)
+	return fanoutPrograms(idx, c, "install", options.programs, options.parallelism,
+		func(ctx context.Context, progname string, printch chan<- string) error {
+			return installProgram(ctx, idx, progname, options.force, printch)
+		})
+}
+
+func installProgram(ctx context.Context,
+	idx *shells.Indexsh, progname string, force bool, printch chan<- string) (err error) {
+
+	printch <- fmt.Sprintf("** Installing %v ...\n", progname)
+	pconf := idx.Fabric.Config.GetProgramConfig(progname)
+	if pconf == nil {
+		return fmt.Errorf("Program name %v not configured", progname)
 	}
-	return
+	if dir := pconf.TargetRoot; dir != "" {
+		err = idx.Fabric.MakeRemoteDirs(ctx, pconf.TargetHost, pconf.User, dir, printch)
+	}
+	if err != nil {
+		return
+	}
+	return idx.Fabric.InstallProgram(ctx, progname, printch, force)
 }
 
 func init() {
@@ -1,6 +1,8 @@
 package commands
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
 	"github.com/couchbaselabs/cbsh/shells"
@@ -8,10 +10,26 @@ import (
 
 const killDescription = `Kill remote program`
 const killHelp = `
-    kill <programnames>
+    kill [-all] [-p n] <programnames|all>
 
 kill remote programs. 'programnames' can be a single program name or list of
-program names separated by white-space.
+program names separated by white-space, or "all" for every configured
+program. Programs are killed before the programs they depend on, refer to
+"depends_on" in "help run".
+
+a program is killed by sending its "kill.signals", default TERM followed by
+KILL, one after the other to the process group of its remote shell till
+the processes are gone, waiting for "kill.timeout" seconds, default 10,
+after each signal. Programs whose processes are still running after the
+last signal fail to be killed. ctrl-C stops waiting.
+
+-all also sweeps the hosts of the programs, upto -p of them at a time, for
+stray processes of program's user, like the ones left behind by an earlier
+session, and kills them the same way. Stray processes run the executable
+launched by the last command of program's "command", by path or by name or
+as a script, with its "commandargs", or are the shell cbsh launched the
+program with. Processes of started programs are not swept. -all without
+'programnames' applies to every configured program.
 `
 
 type KillCommand struct{}
@@ -41,13 +59,52 @@ func (cmd *KillCommand) Complete(c *api.Context, cursor int) []string {
 }
 
 func (cmd *KillCommand) Interpret(c *api.Context) (err error) {
-	if idx, ok := c.Cursh.(*shells.Indexsh); ok {
-		programs, _ := api.ParseCmdline(c.Line)
-		for _, name := range programs[1:] {
-			idx.Fabric.KillProgram(name)
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	sweep, parallelism := false, 0
+	fl := flag.NewFlagSet("kill", flag.ContinueOnError)
+	fl.BoolVar(&sweep, "all", false, "sweep stray processes of programs")
+	parallelFlag(fl, &parallelism)
+	if err = fl.Parse(args[1:]); err != nil {
+		return
+	}
+	programs := fl.Args()
+	if (len(programs) == 1 && programs[0] == "all") || (sweep && len(programs) == 0) {
+		programs = idx.Fabric.Config.ProgramNames()
+	} else if len(programs) == 0 {
+		return fmt.Errorf("Specify programs to kill")
+	}
+	programs = idx.Fabric.Config.StartOrder(programs)
+
+	killed, failed := 0, 0
+	for i := len(programs) - 1; i >= 0; i-- {
+		if idx.Fabric.GetProgram(programs[i]) == nil {
+			continue
+		}
+		killed++
+		if err := idx.Fabric.KillProgram(c.Ctx(), programs[i]); err != nil {
+			failed++
+			idx.Printch <- fmt.Sprintln(err)
 		}
-	} else {
-		err = fmt.Errorf("Shell not supported")
+	}
+	idx.Flush()
+	if sweep {
+		err = fanoutPrograms(idx, c, "sweep", programs, parallelism,
+			func(ctx context.Context, name string, printch chan<- string) error {
+				n, err := idx.Fabric.Sweep(ctx, name, printch)
+				if n > 0 && err == nil {
+					printch <- fmt.Sprintf("killed %v stray processes\n", n)
+				}
+				return err
+			})
+	}
+	if failed > 0 && err == nil {
+		err = fmt.Errorf("%v of %v failed to be killed", failed, killed)
 	}
 	return
 }
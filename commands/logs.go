@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"regexp"
+	"strings"
+)
+
+const logsDescription = `Show recent output of a program`
+const logsHelp = `
+    logs <program> [-n N] [-f] [-grep regex] [-stderr]
+
+show the last N lines, default 20, of program's stdout. cbsh keeps upto
+"log.maxsize" lines of stdout, and of stderr, for every program across its
+restarts, till a configuration is loaded.
+  -n       number of lines, 0 for all the kept lines
+  -f       follow, print lines as the program outputs them till ctrl-C
+  -grep    only the lines matching regex
+  -stderr  program's stderr instead of stdout
+`
+
+type LogsCommand struct{}
+
+type logsOptions struct {
+	lines  int
+	follow bool
+	grep   string
+	stderr bool
+}
+
+func (cmd *LogsCommand) Name() string {
+	return "logs"
+}
+
+func (cmd *LogsCommand) Description() string {
+	return logsDescription
+}
+
+func (cmd *LogsCommand) Help() string {
+	return logsHelp
+}
+
+func (cmd *LogsCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *LogsCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *LogsCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	args, name := args[1:], ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") { // program first
+		name, args = args[0], args[1:]
+	}
+	options := logsOptions{}
+	fl := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fl.IntVar(&options.lines, "n", 20, "number of lines, 0 for all")
+	fl.BoolVar(&options.follow, "f", false, "follow program's output")
+	fl.StringVar(&options.grep, "grep", "", "only the lines matching regex")
+	fl.BoolVar(&options.stderr, "stderr", false, "program's stderr instead of stdout")
+	if err = fl.Parse(args); err != nil {
+		return
+	} else if name == "" && fl.NArg() == 1 {
+		name = fl.Arg(0)
+	} else if name == "" || fl.NArg() > 0 {
+		return fmt.Errorf("Specify a program")
+	}
+	if idx.Fabric.Config.GetProgramConfig(name) == nil {
+		return fmt.Errorf("Program name %v not configured", name)
+	} else if options.lines < 0 {
+		return fmt.Errorf("-n should not be negative")
+	}
+	var re *regexp.Regexp
+	if options.grep != "" {
+		if re, err = regexp.Compile(options.grep); err != nil {
+			return fmt.Errorf("Invalid -grep: %v", err)
+		}
+	}
+
+	log := idx.Fabric.Logs(name, options.stderr)
+	lines, next, changed := log.Since(0)
+	lines = grepLines(lines, re)
+	if options.lines > 0 && len(lines) > options.lines {
+		lines = lines[len(lines)-options.lines:]
+	}
+	printLines(c, lines)
+	for options.follow {
+		select {
+		case <-changed:
+			lines, next, changed = log.Since(next)
+			printLines(c, grepLines(lines, re))
+		case <-c.Ctx().Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// grepLines returns `lines` that match `re`, all of them for nil `re`.
+func grepLines(lines []string, re *regexp.Regexp) []string {
+	if re == nil {
+		return lines
+	}
+	matched := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if re.MatchString(line) {
+			matched = append(matched, line)
+		}
+	}
+	return matched
+}
+
+func printLines(c *api.Context, lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(c.W, api.Redact(line))
+	}
+}
+
+func init() {
+	knownCommands["logs"] = &LogsCommand{}
+}
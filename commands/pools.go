@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"text/tabwriter"
+	"time"
+)
+
+const poolsDescription = `Show ssh connection pools of the cluster`
+const poolsHelp = `
+    pools
+
+show statistics of ssh connection pools, one per user@host,
+  size     - configured "ssh.pool.size"
+  in-use   - connections handed out to commands and programs
+  sessions - sessions open on connections in use, upto 8 per connection
+  idle     - connections waiting in the pool
+  overflow - open connections beyond size, upto "ssh.pool.overflow"
+  gets     - number of times a connection was asked for
+  creates  - connections dialed
+  failures - gets that failed, to dial or for "ssh.pool.timeout"
+  evicted  - idle connections closed after "ssh.pool.idletimeout"
+  dead     - idle connections closed for not replying to keepalive
+  avg-wait, max-wait - time waited to get a connection
+
+commands, programs, transfers and readiness probes open sessions, or
+forwarded connections, on connections in use, upto 8 at a time on each, a
+connection is handed out of the pool only when those in use are full. So
+upto 8 times ("ssh.pool.size" + "ssh.pool.overflow") sessions, 48 by
+default, can be open at a time to a user@host, more wait upto
+"ssh.pool.timeout" seconds, default 60, for one of them to close. "push"
+and "pull" use 2 sessions, for sftp and checksums. "kill" may open 2 more
+sessions on each connection, to kill programs without waiting.
+
+idle connections are probed with a keepalive before reuse, dead ones are
+closed and a new connection is dialed in their place. Counters are kept
+across config reloads. Options to log into hosts, and ssh timeouts, are
+described in "help config".
+`
+
+type PoolsCommand struct{}
+
+func (cmd *PoolsCommand) Name() string {
+	return "pools"
+}
+
+func (cmd *PoolsCommand) Description() string {
+	return poolsDescription
+}
+
+func (cmd *PoolsCommand) Help() string {
+	return poolsHelp
+}
+
+func (cmd *PoolsCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *PoolsCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *PoolsCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	statss := idx.Fabric.PoolStats()
+	if len(statss) == 0 {
+		fmt.Fprintln(c.W, "No connection pools")
+		return
+	}
+	w := tabwriter.NewWriter(c.W, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "pool\tsize\tin-use\tsessions\tidle\toverflow\tgets\tcreates\t"+
+		"failures\tevicted\tdead\tavg-wait\tmax-wait")
+	for _, stats := range statss {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			stats.Key, stats.Size, stats.InUse, stats.Sessions, stats.Idle, stats.Overflow,
+			stats.Gets, stats.Creates, stats.Failures, stats.Evicted, stats.Dead,
+			stats.AvgWait().Round(time.Microsecond), stats.MaxWait.Round(time.Microsecond))
+	}
+	return w.Flush()
+}
+
+func init() {
+	knownCommands["pools"] = &PoolsCommand{}
+}
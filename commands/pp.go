@@ -18,7 +18,11 @@ const ppHelp = `
 for Cbsh shell:
     pp [-pool] [-bucket]
 
-pretty prints is based on the shell in which it is invoked.
+for Index shell:
+    pp
+
+pretty prints is based on the shell in which it is invoked. In index shell it
+prints the settings of loaded configuration, with secret values redacted.
 `
 
 type PpCommand struct{}
@@ -53,7 +57,7 @@ func (cmd *PpCommand) Interpret(c *api.Context) (err error) {
 	if cbsh, ok := c.Cursh.(*shells.Cbsh); ok {
 		cmd.ppForCbsh(cbsh, c)
 	} else if index, ok := c.Cursh.(*shells.Indexsh); ok {
-		cmd.ppForIndex(index, c)
+		err = cmd.ppForIndex(index, c)
 	} else if n1ql, ok := c.Cursh.(*shells.N1qlsh); ok {
 		cmd.ppForN1ql(n1ql, c)
 	} else {
@@ -91,6 +95,14 @@ func (cmd *PpCommand) ppForCbsh(cbsh *shells.Cbsh, c *api.Context) (err error) {
 }
 
 func (cmd *PpCommand) ppForIndex(index *shells.Indexsh, c *api.Context) (err error) {
+	var s string
+
+	if index.Config == nil {
+		return fmt.Errorf("Configuration file not loaded")
+	}
+	if s, err = api.PrettyPrint(*index.Config, ""); err == nil {
+		fmt.Fprintln(c.W, api.Redact(s))
+	}
 	return
 }
 
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"os"
+	"path/filepath"
+)
+
+const pullDescription = `Copy files from program's host`
+const pullHelp = `
+    pull [-p n] <remotepath> <localdir> <programnames>
+
+copy file or directory 'remotepath' from the target host of every program
+into 'localdir'/<programname>/, like configuration and log files. Relative
+'remotepath' is relative to the program's "targetroot", if configured, else
+to user's home directory.
+
+files are copied over sftp on pooled ssh connections, refer to "help push".
+Checksum of every file is verified on the target host with sha256sum.
+`
+
+type PullCommand struct{}
+
+func (cmd *PullCommand) Name() string {
+	return "pull"
+}
+
+func (cmd *PullCommand) Description() string {
+	return pullDescription
+}
+
+func (cmd *PullCommand) Help() string {
+	return pullHelp
+}
+
+func (cmd *PullCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *PullCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *PullCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	parallelism := 0
+	fl := flag.NewFlagSet("pull", flag.ContinueOnError)
+	parallelFlag(fl, &parallelism)
+	if err = fl.Parse(args[1:]); err != nil {
+		return
+	} else if fl.NArg() < 3 {
+		return fmt.Errorf("Specify remotepath, localdir and programs")
+	}
+	remote, localdir := fl.Arg(0), fl.Arg(1)
+	return fanoutPrograms(idx, c, "pull", fl.Args()[2:], parallelism,
+		func(ctx context.Context, progname string, printch chan<- string) error {
+			pconf := idx.Fabric.Config.GetProgramConfig(progname)
+			if pconf == nil {
+				return fmt.Errorf("Program name %v not configured", progname)
+			}
+			local := filepath.Join(localdir, progname)
+			if err := os.MkdirAll(local, 0755); err != nil {
+				return err
+			}
+			stats, err := idx.Fabric.Pull(ctx, pconf.TargetHost, pconf.User,
+				targetPath(pconf, remote), local, printch)
+			if err == nil {
+				printTransfer(printch, "pulled", stats)
+			}
+			return err
+		})
+}
+
+func init() {
+	knownCommands["pull"] = &PullCommand{}
+}
@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"github.com/couchbaselabs/cbsh/sshc"
+	"path"
+	"time"
+)
+
+const pushDescription = `Copy local files to program's host`
+const pushHelp = `
+    push [-p n] <localpath> <remotepath> <programnames>
+
+copy local file or directory 'localpath' to 'remotepath' on the target host
+of every program, like prebuilt binaries or configuration files. If
+'remotepath' is an existing directory 'localpath' is copied into it, missing
+parent directories are created. Relative 'remotepath' is relative to the
+program's "targetroot", if configured, else to user's home directory.
+
+files are copied over sftp on pooled ssh connections, programs on the local
+host are copied locally. Checksum of every file is verified on the target
+host with sha256sum. Programs are copied to in parallel, upto -p of them at
+a time, refer to "help install".
+`
+
+type PushCommand struct{}
+
+func (cmd *PushCommand) Name() string {
+	return "push"
+}
+
+func (cmd *PushCommand) Description() string {
+	return pushDescription
+}
+
+func (cmd *PushCommand) Help() string {
+	return pushHelp
+}
+
+func (cmd *PushCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *PushCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *PushCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	parallelism := 0
+	fl := flag.NewFlagSet("push", flag.ContinueOnError)
+	parallelFlag(fl, &parallelism)
+	if err = fl.Parse(args[1:]); err != nil {
+		return
+	} else if fl.NArg() < 3 {
+		return fmt.Errorf("Specify localpath, remotepath and programs")
+	}
+	local, remote := fl.Arg(0), fl.Arg(1)
+	return fanoutPrograms(idx, c, "push", fl.Args()[2:], parallelism,
+		func(ctx context.Context, progname string, printch chan<- string) error {
+			pconf := idx.Fabric.Config.GetProgramConfig(progname)
+			if pconf == nil {
+				return fmt.Errorf("Program name %v not configured", progname)
+			}
+			stats, err := idx.Fabric.Push(ctx, pconf.TargetHost, pconf.User,
+				local, targetPath(pconf, remote), printch)
+			if err == nil {
+				printTransfer(printch, "pushed", stats)
+			}
+			return err
+		})
+}
+
+// targetPath returns `p` on program's host, relative paths are relative to
+// "targetroot" if configured.
+func targetPath(pconf *api.ProgramConfig, p string) string {
+	if pconf.TargetRoot != "" && !path.IsAbs(p) {
+		return path.Join(pconf.TargetRoot, p)
+	}
+	return p
+}
+
+func printTransfer(printch chan<- string, verb string, stats *sshc.TransferStats) {
+	printch <- fmt.Sprintf("%v %v files, %v bytes in %v\n",
+		verb, stats.Files, stats.Bytes, stats.Duration.Round(time.Millisecond))
+}
+
+func init() {
+	knownCommands["push"] = &PushCommand{}
+}
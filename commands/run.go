@@ -1,19 +1,53 @@
 package commands
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
 	"github.com/couchbaselabs/cbsh/shells"
-	//"github.com/couchbaselabs/cbsh/sshc"
+	"github.com/couchbaselabs/cbsh/sshc"
 )
 
 var runDescription = `Execute configuration for seconday index cluster`
 var runHelp = `
-    run [-c configfile] [-i] [-if] <programnames>
+    run [-c configfile] [-profile name] [-set key=value]... [-i] [-if] [-p n] <programnames|all>
 
 run specified programs. 'programnames' can be a single program name or list of
-program names separated by white-space.
+program names separated by white-space, or "all" for every configured
+program. Programs are installed, with -i or -if, and launched in parallel,
+upto -p of them at a time, refer to "help install". A program that failed
+to install is not launched.
+
+programs targeting localhost, or a loopback address, as the user running
+cbsh are installed and launched as local processes without ssh, {{.USER}}
+in configuration is that user.
+
+a program is launched only after the programs in its "depends_on" are
+ready, whether they are launched by the same command or are already
+running, and run waits for the launched programs to be ready. "kill" kills
+programs before their dependencies. A program is ready once launched, or
+when its "ready" probe succeeds,
+  {"tcp": "[host]:port"}  - connecting to the address, from target host,
+                           succeeds, host defaults to localhost
+  {"http": "url"}         - url, from target host, responds with 200
+  {"log": "regex"}        - a line of program's output matches regex
+along with "timeout", default 60, the seconds to wait for the program to be
+ready and "interval", default 1, the seconds between tcp or http probes.
+
+"restart" policy of a program starts it again once it stops on its own,
+"never", the default, "on-failure" when it exits unsuccessfully or fails to
+launch, or "always". Restarts wait for "restart.backoff" seconds, default 1,
+doubled for every restart in a row upto "restart.maxbackoff" seconds,
+default 60 or "restart.backoff" if that is longer. A program that ran
+longer than "restart.maxbackoff" starts afresh. "restart.maxretries" is
+the number of restarts in a row before giving up, default 0 for no limit.
+Killed programs are not restarted and restarts are listed by
+"status -events".
+
+-profile and -set override properties of the configuration, refer to "help
+config". Without -c, they re-load current configuration file with the new
+overrides, which restarts the cluster, before running the programs.
 `
 
 type RunCommand struct{}
@@ -22,7 +56,9 @@ type runOptions struct {
 	configfile   string
 	install      bool
 	forceinstall bool
+	parallelism  int
 	programs     []string
+	overrideOptions
 }
 
 func (cmd *RunCommand) Name() string {
@@ -64,41 +100,80 @@ func (cmd *RunCommand) argParse(options *runOptions, args []string) *flag.FlagSe
 	fl := flag.NewFlagSet("run", flag.ContinueOnError)
 	fl.StringVar(&options.configfile, "c", "",
 		"load configuration file before installing or running the program")
+	options.flags(fl)
 	fl.BoolVar(&options.install, "i", false,
 		"install programs before running them")
 	fl.BoolVar(&options.forceinstall, "if", false,
 		"force install programs before running them")
+	parallelFlag(fl, &options.parallelism)
 	fl.Parse(args)
 	return fl
 }
 
 func runForIndex(idx *shells.Indexsh, options *runOptions, c *api.Context) (err error) {
+	overrides, err := options.overrides()
+	if err != nil {
+		return
+	}
 	switch {
 	case options.configfile != "":
-		if err = configForIndex(idx, c, options.configfile); err == nil {
-			runPrograms(idx, c, options.programs)
-		}
-	case idx.Config != nil:
-		opts := installOptions{programs: options.programs}
-		if options.forceinstall {
-			opts.force = options.forceinstall
+		if err = configForIndex(idx, c, options.configfile, overrides); err == nil {
+			err = runPrograms(idx, c, options)
 		}
-		if options.forceinstall || options.install {
-			installForIndex(idx, &opts, c)
+	case idx.Config != nil && !options.isEmpty():
+		overrides = reloadOverrides(idx, overrides)
+		if err = configForIndex(idx, c, idx.ConfigFile, overrides); err == nil {
+			err = runPrograms(idx, c, options)
 		}
-		runPrograms(idx, c, options.programs)
+	case idx.Config != nil:
+		err = runPrograms(idx, c, options)
 	default:
 		return fmt.Errorf("Configuration file not loaded")
 	}
 	return
 }
 
-func runPrograms(idx *shells.Indexsh, c *api.Context, programs []string) (err error) {
+// runPrograms installs, if asked for, and launches programs in parallel,
+// in the order of their dependencies.
+func runPrograms(idx *shells.Indexsh, c *api.Context, options *runOptions) error {
+	if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	install := options.install || options.forceinstall
+	programs := options.programs
+	if len(programs) == 1 && programs[0] == "all" {
+		programs = idx.Fabric.Config.ProgramNames()
+	}
+	// programs are started by fan-out in this order, so that dependencies
+	// are never waiting behind the programs waiting for them.
+	programs = idx.Fabric.Config.StartOrder(programs)
+	launches := make(map[string]*sshc.Launch)
 	for _, name := range programs {
-		idx.Fabric.KillProgram(name)
-		idx.Fabric.RunProgram(name, idx.Printch)
+		launches[name] = sshc.NewLaunch()
 	}
-	return
+	return fanoutPrograms(idx, c, "run", programs, options.parallelism,
+		func(ctx context.Context, name string, printch chan<- string) (err error) {
+			defer func() { launches[name].Done(err) }()
+			if install {
+				err = installProgram(ctx, idx, name, options.forceinstall, printch)
+				if err != nil {
+					return
+				}
+			}
+			if err = idx.Fabric.WaitDepends(ctx, name, launches, printch); err != nil {
+				return
+			}
+			if idx.Fabric.GetProgram(name) != nil {
+				if err = idx.Fabric.KillProgram(ctx, name); err != nil {
+					return
+				}
+			}
+			// program prefixes its own output and outlives the fan-out.
+			if _, err = idx.Fabric.RunProgram(name, idx.Printch); err != nil {
+				return
+			}
+			return idx.Fabric.WaitReady(ctx, name)
+		})
 }
 
 func init() {
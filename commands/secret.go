@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"golang.org/x/term"
+	"os"
+	"sort"
+)
+
+const secretDescription = `Manage secrets referred by configuration`
+const secretHelp = `
+    secret [-f secrets-file] list
+    secret [-f secrets-file] set <name> [value]
+    secret [-f secrets-file] rm <name>
+
+manage secrets in the encrypted secrets file, which is decrypted using the
+passphrase in CBSH_SECRETS_PASSPHRASE environment variable. If -f is not
+supplied, the secrets file of loaded configuration is used, which is the
+"secrets" property of the configuration, or ~/.cbsh/secrets.
+
+"list" prints only the names of secrets. If [value] is not supplied to "set",
+it is prompted for without echoing it, so that the value is neither shown
+nor saved in command history.
+
+Secrets, like passwords, are referred as {{secret "name"}} in configuration
+values and are resolved when loading the configuration, from environment
+variable CBSH_SECRET_<NAME> or else from the secrets file. Secret values
+are redacted in everything cbsh prints.
+`
+
+type SecretCommand struct{}
+
+type secretOptions struct {
+	file string
+}
+
+func (cmd *SecretCommand) Name() string {
+	return "secret"
+}
+
+func (cmd *SecretCommand) Description() string {
+	return secretDescription
+}
+
+func (cmd *SecretCommand) Help() string {
+	return secretHelp
+}
+
+func (cmd *SecretCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *SecretCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *SecretCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	options := secretOptions{}
+	fl := cmd.argParse(&options, args[1:])
+	args = fl.Args()
+	if len(args) < 1 {
+		return fmt.Errorf("Specify one of list, set or rm")
+	}
+	if options.file == "" {
+		options.file = api.DefaultSecretsFile()
+		if idx.Config != nil {
+			options.file = idx.Config.SecretsFile
+		}
+	}
+
+	passphrase := os.Getenv(api.SECRETS_PASSPHRASE_ENV)
+	if passphrase == "" {
+		return fmt.Errorf("Set %v to access %v", api.SECRETS_PASSPHRASE_ENV, options.file)
+	}
+	values, err := api.ReadSecretsFile(options.file, passphrase)
+	if err != nil {
+		return
+	}
+	switch {
+	case args[0] == "list":
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(c.W, name)
+		}
+	case args[0] == "set" && len(args) > 1:
+		value := ""
+		if len(args) > 2 {
+			value = args[2]
+		} else if value, err = readSecret(c, args[1]); err != nil {
+			return
+		}
+		values[args[1]] = value
+		err = api.WriteSecretsFile(options.file, passphrase, values)
+	case args[0] == "rm" && len(args) > 1:
+		if _, ok := values[args[1]]; !ok {
+			return fmt.Errorf("Secret %q not found in %v", args[1], options.file)
+		}
+		delete(values, args[1])
+		err = api.WriteSecretsFile(options.file, passphrase, values)
+	default:
+		err = fmt.Errorf("Specify one of list, set <name> or rm <name>")
+	}
+	return
+}
+
+// readSecret prompts for the value of secret `name` and reads it from the
+// terminal without echo, bypassing the line editor and its history.
+func readSecret(c *api.Context, name string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("Specify value for %v, standard input is not a terminal", name)
+	}
+	fmt.Fprintf(c.W, "value for %v: ", name)
+	value, err := term.ReadPassword(fd)
+	fmt.Fprintln(c.W)
+	return string(value), err
+}
+
+func (cmd *SecretCommand) argParse(options *secretOptions, args []string) *flag.FlagSet {
+	fl := flag.NewFlagSet("secret", flag.ContinueOnError)
+	fl.StringVar(&options.file, "f", "",
+		"secrets file to manage")
+	fl.Parse(args)
+	return fl
+}
+
+func init() {
+	knownCommands["secret"] = &SecretCommand{}
+}
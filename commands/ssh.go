@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"os"
+)
+
+const sshDescription = `Open an interactive shell on program's host`
+const sshHelp = `
+    ssh <program|[user@]host>
+
+open an interactive login shell on the target host of a program, as its
+user and with its environ, or on a host, refer to "help exec". The shell
+runs on a pseudo terminal over a pooled ssh connection, programs on the
+local host get a local shell. Exit the shell to return to cbsh.
+`
+
+type SshCommand struct{}
+
+func (cmd *SshCommand) Name() string {
+	return "ssh"
+}
+
+func (cmd *SshCommand) Description() string {
+	return sshDescription
+}
+
+func (cmd *SshCommand) Help() string {
+	return sshHelp
+}
+
+func (cmd *SshCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *SshCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *SshCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	if len(args) != 2 {
+		return fmt.Errorf("Specify a program or host")
+	}
+	names, targets, err := execTargets(idx, args[1], false)
+	if err != nil {
+		return
+	}
+	t := targets[names[0]]
+	idx.Flush()
+	return idx.Fabric.Shell(c.Ctx(), t.host, t.user, t.environ, os.Stdin, os.Stdout)
+}
+
+func init() {
+	knownCommands["ssh"] = &SshCommand{}
+}
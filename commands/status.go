@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/couchbaselabs/cbsh/shells"
+	"github.com/couchbaselabs/cbsh/sshc"
+	"text/tabwriter"
+	"time"
+)
+
+const statusDescription = `Show state of programs in the cluster`
+const statusHelp = `
+    status [-events]
+    ps [-events]
+
+list every configured program with,
+  state    - stopped, installing, starting, running, exited(code), killed,
+             failed or restarting(in duration)
+  host     - target host
+  pid      - of the remote shell running the program
+  uptime   - time since the program was started, while running
+  restarts - number of times the program was started after the first time
+  error    - why the program failed
+
+a program is "stopped" till it is started, and after it is installed. Its
+state moves to "exited" when it exits on its own, with its exit code or
+signal, and to "killed" when it is killed by cbsh. Failing to install or to
+launch a program moves it to "failed". Programs with a "restart" policy,
+refer to "help run", are "restarting" while waiting to be started again.
+
+-events lists recent events of programs, like their restarts, instead.
+`
+
+type StatusCommand struct {
+	name string // status or ps
+}
+
+func (cmd *StatusCommand) Name() string {
+	return cmd.name
+}
+
+func (cmd *StatusCommand) Description() string {
+	return statusDescription
+}
+
+func (cmd *StatusCommand) Help() string {
+	return statusHelp
+}
+
+func (cmd *StatusCommand) Shells() []string {
+	return []string{api.SHELL_INDEX}
+}
+
+func (cmd *StatusCommand) Complete(c *api.Context, cursor int) []string {
+	return []string{}
+}
+
+func (cmd *StatusCommand) Interpret(c *api.Context) (err error) {
+	idx, ok := c.Cursh.(*shells.Indexsh)
+	if !ok {
+		return fmt.Errorf("Shell not supported")
+	} else if idx.Fabric == nil {
+		return fmt.Errorf("Configuration not loaded")
+	}
+	args, _ := api.ParseCmdline(c.Line)
+	events := false
+	fl := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fl.BoolVar(&events, "events", false, "list recent events of programs")
+	if err = fl.Parse(args[1:]); err != nil {
+		return
+	} else if events {
+		return printEvents(c, idx.Fabric.Events())
+	}
+
+	statuss := idx.Fabric.ProgramStatus()
+	if len(statuss) == 0 {
+		fmt.Fprintln(c.W, "No programs configured")
+		return
+	}
+	w := tabwriter.NewWriter(c.W, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "program\tstate\thost\tpid\tuptime\trestarts\terror")
+	for _, st := range statuss {
+		pid, uptime, reason := "-", "-", ""
+		if st.Pid > 0 {
+			pid = fmt.Sprintf("%v", st.Pid)
+		}
+		if d := st.Uptime(); d > 0 {
+			uptime = d.Round(time.Second).String()
+		}
+		if st.State == sshc.PROGRAM_FAILED && st.Err != nil {
+			reason = st.Err.Error()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			st.Name, st.Describe(), st.Host, pid, uptime, st.Restarts, reason)
+	}
+	return w.Flush()
+}
+
+func printEvents(c *api.Context, events []*sshc.Event) error {
+	if len(events) == 0 {
+		fmt.Fprintln(c.W, "No events")
+		return nil
+	}
+	for _, event := range events {
+		fmt.Fprintln(c.W, event)
+	}
+	return nil
+}
+
+func init() {
+	knownCommands["status"] = &StatusCommand{name: "status"}
+	knownCommands["ps"] = &StatusCommand{name: "ps"}
+}
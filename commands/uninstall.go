@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
@@ -9,12 +10,13 @@ import (
 
 const uninstallDescription = `Uninstall remote program`
 const uninstallHelp = `
-    uninstall <programname>
+    uninstall [-p n] <programname>
 
 uninstall will remote the target repository from target-host.
 
 'programnames' can be a single program name or list of program names separated
-by white-space.
+by white-space. Programs are uninstalled in parallel, upto -p of them at a
+time, refer to "help install".
 `
 
 type UninstallCommand struct{}
@@ -39,8 +41,9 @@ func (cmd *UninstallCommand) Complete(c *api.Context, cursor int) []string {
 	return []string{}
 }
 
-func (cmd *UninstallCommand) argParse(args []string) *flag.FlagSet {
+func (cmd *UninstallCommand) argParse(args []string, parallelism *int) *flag.FlagSet {
 	fl := flag.NewFlagSet("uninstall", flag.ContinueOnError)
+	parallelFlag(fl, parallelism)
 	fl.Parse(args)
 	return fl
 }
@@ -56,11 +59,13 @@ func (cmd *UninstallCommand) Interpret(c *api.Context) (err error) {
 
 func (cmd *UninstallCommand) uninstallForIndex(idx *shells.Indexsh, c *api.Context) (err error) {
 	args, _ := api.ParseCmdline(c.Line)
-	for _, progname := range args[1:] {
-		idx.Printch <- fmt.Sprintf("** Uninstalling %v ...\n", progname)
-		err = idx.Fabric.UninstallProgram(progname, idx.Printch)
-	}
-	return
+	parallelism := 0
+	fl := cmd.argParse(args[1:], &parallelism)
+	return fanoutPrograms(idx, c, "uninstall", fl.Args(), parallelism,
+		func(ctx context.Context, progname string, printch chan<- string) error {
+			printch <- fmt.Sprintf("** Uninstalling %v ...\n", progname)
+			return idx.Fabric.UninstallProgram(ctx, progname, printch)
+		})
 }
 
 func init() {
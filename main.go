@@ -42,25 +42,37 @@ func main() {
 		Commands: commands.Allcommands(),
 	}
 	argParse(&context)
+	status := 0 // exit status, non-zero if command-line could not be executed
 	if err := context.SetShell(context.Shells[option.shell]); err != nil {
-		fmt.Fprintln(context.W, err)
+		fmt.Fprintln(context.W, api.Redact(err.Error()))
+		if _, ok := context.Cursh.(*shells.Indexsh); ok { // invalid -config
+			status = 1
+		}
 	}
 	context.Liner = liner.NewLiner()
+	go signalCatcher(&context)
 
 	// Execute command if supplied through command-line
-	if option.cmdstr != "" {
+	switch {
+	case option.cmdstr == "":
+		option.interactive = true
+	case status != 0: // index shell failed to load -config
+	default:
 		if err := doCommand(&context, option.cmdstr); err != nil {
-			fmt.Fprintln(context.W, err)
+			fmt.Fprintln(context.W, api.Redact(err.Error()))
+			status = 1
+		} else if idx, ok := context.Cursh.(*shells.Indexsh); ok && !option.interactive {
+			// programs launched by the command live only as long as the
+			// shell, wait for them to exit.
+			idx.Wait()
 		}
-	} else {
-		option.interactive = true
 	}
 
-	go signalCatcher(&context)
 	if option.interactive {
 		interactiveLoop(&context)
 	}
 	(&context).Close()
+	os.Exit(status)
 }
 
 func interactiveLoop(c *api.Context) {
@@ -77,7 +89,7 @@ func interactiveLoop(c *api.Context) {
 		} else {
 			UpdateHistory(c, line)
 			if err := doCommand(c, line); err != nil {
-				fmt.Fprintln(c.W, err)
+				fmt.Fprintln(c.W, api.Redact(err.Error()))
 			}
 		}
 	}
@@ -93,6 +105,9 @@ func doCommand(c *api.Context, line string) (err error) {
 	case strings.HasPrefix(line, api.SHELL_INDEX):
 		err = c.SetShell(c.Shells[api.SHELL_INDEX])
 	default:
+		// ctrl-C cancels the commands in line, refer signalCatcher.
+		end := c.BeginCommand()
+		defer end()
 		for _, command := range api.ParseCmdsline(line) {
 			c.Line = strings.Join(command, " ")
 			// Handle the command for the current shell
@@ -133,12 +148,17 @@ func handleShellCommand(c *api.Context) (err error) {
 	return
 }
 
-// Attempt to clean up after ctrl-C otherwise
-// terminal is left in bad shape
+// ctrl-C cancels the in-flight command, if any, otherwise attempt to clean
+// up and exit, else terminal is left in bad shape
 func signalCatcher(c *api.Context) {
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT)
-	<-ch
-	c.Close()
-	os.Exit(0)
+	for range ch {
+		if c.CancelCommand() {
+			fmt.Fprintln(c.W, "Cancelling ...")
+			continue
+		}
+		c.Close()
+		os.Exit(0)
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
 	"github.com/couchbaselabs/cbsh/sshc"
+	"os"
 	"path"
 )
 
@@ -12,8 +13,9 @@ var idxDescription = `Shell to handle secondary index cluster`
 
 // Global structure that maintains the current state of the index-shell
 type Indexsh struct {
-	ConfigFile  string     // path to configuration file
-	Config      api.Config // configuration
+	ConfigFile  string          // path to configuration file
+	Config      *api.Settings   // configuration
+	Overrides   []*api.Override // -profile and -set overrides for ConfigFile
 	Fabric      *sshc.Fabric
 	CommandList // commands loaded for this shell
 	Printch     chan string
@@ -26,14 +28,65 @@ func (idx *Indexsh) Description() string {
 
 func (idx *Indexsh) Init(c *api.Context, commands api.CommandMap) (err error) {
 	api.CreateFile(idx.HistoryFile(), false)
-	idx.Config = nil
 	idx.Commands = commands
 	idx.Printch = make(chan string)
 	idx.quit = make(chan bool)
 	go fabricPrinter(c.W, idx.Printch, idx.quit)
+	if idx.Config == nil && idx.ConfigFile != "" { // -config switch
+		fname := idx.ConfigFile
+		idx.ConfigFile = ""
+		if err = idx.LoadConfig(fname, nil); err != nil {
+			return
+		}
+		fmt.Fprintf(c.W, "Loaded config %q ...\n", idx.ConfigFile)
+	}
 	return
 }
 
+// LoadConfig loads configuration from `fname`, refer LoadSettings, and
+// restarts the fabric with it. Current configuration and fabric are left
+// untouched if the new configuration is invalid.
+func (idx *Indexsh) LoadConfig(fname string, overrides []*api.Override) error {
+	config, err := LoadSettings(fname, overrides)
+	if err != nil {
+		return err
+	}
+	fabric, err := sshc.StartFabric(config)
+	if err != nil {
+		return err
+	}
+	if idx.Fabric != nil {
+		idx.Fabric.Close()
+	}
+	idx.ConfigFile, idx.Config, idx.Overrides = fname, config, overrides
+	idx.Fabric = fabric
+	return nil
+}
+
+// Flush returns once everything sent to Printch so far is printed, Printch
+// is unbuffered and printed in order.
+func (idx *Indexsh) Flush() {
+	idx.Printch <- ""
+}
+
+// Wait blocks until all programs started in the fabric have exited.
+func (idx *Indexsh) Wait() {
+	if idx.Fabric != nil {
+		idx.Fabric.Wait()
+	}
+}
+
+// LoadSettings loads configuration file `fname`, with overrides from
+// environment followed by `overrides`, without touching the fabric.
+func LoadSettings(fname string, overrides []*api.Override) (*api.Settings, error) {
+	context := map[string]interface{}{
+		"HOME": os.Getenv("HOME"),
+		"USER": sshc.CurrentUser(),
+	}
+	overrides = append(api.EnvOverrides(os.Environ()), overrides...)
+	return api.LoadConfig(context, fname, "", overrides...)
+}
+
 func (idx *Indexsh) HistoryFile() string {
 	datadir := api.ShellDatadir()
 	return path.Join(datadir, fmt.Sprintf(api.HISTORY_FILE_TMPL, api.SHELL_INDEX))
@@ -2,10 +2,12 @@ package shells
 
 import (
 	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
 	"io"
 )
 
-// worker entry point to print stdout and stderr from remote programs.
+// worker entry point to print stdout and stderr from remote programs, secret
+// values from configuration are redacted.
 func fabricPrinter(w io.Writer, printch <-chan string, kill chan bool) {
 loop:
 	for {
@@ -14,7 +16,7 @@ loop:
 			if !ok {
 				break loop
 			}
-			fmt.Fprintf(w, "%v", s)
+			fmt.Fprintf(w, "%v", api.Redact(s))
 		case <-kill:
 			break loop
 		}
@@ -0,0 +1,224 @@
+package sshc
+
+import (
+	"context"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxJumps limits the chain of jump hosts, to catch a host configured as its
+// own jump host.
+const maxJumps = 4
+
+// sshDialer logs into `host` as `user` using `config`, through `jump` host
+// if it is not nil.
+type sshDialer struct {
+	user   string
+	host   string
+	config *api.SshConfig
+	jump   *sshDialer
+}
+
+// newDialer returns a dialer for `host` as `user` with ssh options from
+// current configuration.
+func (fabric *Fabric) newDialer(host, user string, jumps int) (*sshDialer, error) {
+	if jumps > maxJumps {
+		return nil, fmt.Errorf("Too many jump hosts to reach %v", host)
+	}
+	d := &sshDialer{
+		user:   user,
+		host:   host,
+		config: fabric.Config.SshConfigFor(host, user),
+	}
+	if d.config.JumpHost != "" {
+		juser, jhost := user, d.config.JumpHost
+		if i := strings.LastIndex(jhost, "@"); i >= 0 {
+			juser, jhost = jhost[:i], jhost[i+1:]
+		}
+		jump, err := fabric.newDialer(jhost, juser, jumps+1)
+		if err != nil {
+			return nil, err
+		}
+		d.jump = jump
+	}
+	return d, nil
+}
+
+// addr returns host:port to dial, port in host takes precedence over
+// configured port.
+func (d *sshDialer) addr() string {
+	if _, _, err := net.SplitHostPort(d.host); err == nil {
+		return d.host
+	}
+	return net.JoinHostPort(d.host, strconv.Itoa(d.config.Port))
+}
+
+func (d *sshDialer) String() string {
+	if d.jump != nil {
+		return fmt.Sprintf("%v@%v via %v", d.user, d.addr(), d.jump)
+	}
+	return fmt.Sprintf("%v@%v", d.user, d.addr())
+}
+
+// mkConn creates a new ssh connection, giving up if `ctx` is cancelled.
+func (d *sshDialer) mkConn(ctx context.Context) (client *ssh.Client, err error) {
+	config, closer, err := d.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	var conn net.Conn
+	if d.jump == nil {
+		dialer := net.Dialer{Timeout: config.Timeout}
+		if conn, err = dialer.DialContext(ctx, "tcp", d.addr()); err != nil {
+			return nil, err
+		}
+	} else {
+		jump, err := d.jump.mkConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		jconn, err := jump.DialContext(ctx, "tcp", d.addr())
+		if err != nil {
+			jump.Close()
+			return nil, fmt.Errorf("%v: %v", d, err)
+		}
+		conn = &jumpConn{jconn, jump}
+	}
+	if client, err = d.handshake(ctx, conn, config); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.keepAlive(client)
+	return client, nil
+}
+
+// handshake establishes ssh connection over `conn`, giving up after
+// handshake timeout or if `ctx` is cancelled. Deadlines are not supported by
+// connections tunneled through a jump host, hence `conn` is closed instead.
+func (d *sshDialer) handshake(
+	ctx context.Context, conn net.Conn, config *ssh.ClientConfig) (*ssh.Client, error) {
+
+	timeout := time.Duration(d.config.HandshakeTimeout) * time.Second
+	timer := time.AfterFunc(timeout, func() { conn.Close() })
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr(), config)
+	if !stop() {
+		timer.Stop()
+		return nil, fmt.Errorf("%v: %v", d, ctx.Err())
+	} else if !timer.Stop() {
+		return nil, fmt.Errorf("%v: ssh handshake timed out after %v", d, timeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("%v: %v", d, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// keepAlive sends a keepalive request to `client` every keepalive interval,
+// and closes it if the server does not reply within the interval, so that
+// sessions on a dead connection fail instead of hanging.
+func (d *sshDialer) keepAlive(client *ssh.Client) {
+	if d.config.KeepAlive < 0 {
+		return
+	}
+	interval := time.Duration(d.config.KeepAlive) * time.Second
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := probe(client, interval); err != nil {
+				client.Close()
+				return
+			}
+		}
+	}()
+}
+
+// clientConfig returns ssh client configuration for dialer, `closer` must
+// be called once the connection is established.
+func (d *sshDialer) clientConfig() (config *ssh.ClientConfig, closer func(), err error) {
+	closer = func() {}
+	auths := make([]ssh.AuthMethod, 0)
+
+	// ssh-agent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if agentSock, err := net.Dial("unix", sock); err == nil {
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(agentSock).Signers))
+			closer = func() { agentSock.Close() }
+		}
+	}
+	// private key
+	if d.config.IdentityFile != "" {
+		signer, err := readIdentity(d.config.IdentityFile, d.config.Passphrase)
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	// password
+	if d.config.Password != "" {
+		auths = append(auths, ssh.Password(d.config.Password))
+	}
+	if len(auths) == 0 {
+		return nil, nil, fmt.Errorf("No ssh authentication for %v, "+
+			"configure ssh.identityfile or ssh.password, or start ssh-agent", d)
+	}
+
+	hostKeys := &knownHosts{file: d.config.KnownHosts, mode: d.config.HostKeyCheck}
+	algorithms, err := hostKeys.algorithms(d.addr())
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+	config = &ssh.ClientConfig{
+		User:              d.user,
+		Auth:              auths,
+		HostKeyCallback:   hostKeys.Check,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           time.Duration(d.config.ConnectTimeout) * time.Second,
+	}
+	return config, closer, nil
+}
+
+// readIdentity reads private key from `file`, decrypting it with
+// `passphrase` if it is encrypted.
+func readIdentity(file, passphrase string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if passphrase == "" {
+			return nil, fmt.Errorf("%v: encrypted private key, configure ssh.passphrase", file)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+	return signer, nil
+}
+
+// jumpConn is a connection tunneled through a jump host, closing it closes
+// the connection to the jump host as well.
+type jumpConn struct {
+	net.Conn
+	jump *ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.jump.Close()
+	return err
+}
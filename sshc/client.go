@@ -1,12 +1,16 @@
 package sshc
 
 import (
-	"code.google.com/p/go.crypto/ssh"
+	"context"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
+	"golang.org/x/crypto/ssh"
 	"io"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // TODO: lock protect Fabric.pools and Fabric.programs
@@ -14,6 +18,14 @@ import (
 type outStr chan<- string // for stdout and stderr
 type inStr <-chan string  // for stdin
 
+// transport executes commands on a host, refer sshTransport and
+// localTransport.
+type transport interface {
+	// exec runs `cmd` to completion, or for `daemon` until it exits or
+	// cmd.quit is closed. The command is killed if `ctx` is cancelled.
+	exec(ctx context.Context, cmd *remoteCommand, daemon bool) (*ExecResult, error)
+}
+
 type remoteCommand struct {
 	host    string
 	user    string
@@ -23,22 +35,35 @@ type remoteCommand struct {
 	outch   outStr
 	errch   outStr
 	quit    chan bool
+	capture int  // bytes of output to capture, refer ExecCaptureSize
+	control bool // to kill programs, refer ConnControlSessions
 }
 
 // Fabric is an instance of cluster managment.
 type Fabric struct {
-	Config   api.Config
+	Config   *api.Settings
 	mu       sync.Mutex
 	pools    map[string]*connectionPool
 	programs map[string]*Program
+	statusMu sync.Mutex
+	status   map[string]*ProgramStatus // refer ProgramStatus
+	events   []*Event                  // refer MaxEvents
+	logs     map[string]*programLogs   // refer Logs
 }
 
-// StartFabric creates a new instace of cluster management.
-func StartFabric(config api.Config) (*Fabric, error) {
+// StartFabric creates a new instace of cluster management. Fabric will not
+// be started for an invalid configuration.
+func StartFabric(config *api.Settings) (*Fabric, error) {
+	if config == nil {
+		return nil, fmt.Errorf("Configuration not loaded")
+	} else if err := config.Validate(); err != nil {
+		return nil, err
+	}
 	fabric := Fabric{
 		Config:   config,
 		pools:    make(map[string]*connectionPool),
 		programs: make(map[string]*Program),
+		status:   make(map[string]*ProgramStatus),
 	}
 	return &fabric, nil
 }
@@ -76,60 +101,226 @@ func (fabric *Fabric) DeleteProgram(name string) {
 	}
 }
 
-// Atomically get a connection pool for host
-func (fabric *Fabric) GetPool(host string) *connectionPool {
+// Atomically get a connection pool for key, user@host
+func (fabric *Fabric) GetPool(key string) *connectionPool {
 	fabric.mu.Lock()
 	defer fabric.mu.Unlock()
 	if fabric.pools != nil {
-		return fabric.pools[host]
+		return fabric.pools[key]
 	}
 	return nil
 }
 
-// Atomically set a connection pool for host
-func (fabric *Fabric) SetPool(host string, cp *connectionPool) {
+// Atomically set a connection pool for key, user@host
+func (fabric *Fabric) SetPool(key string, cp *connectionPool) {
 	fabric.mu.Lock()
 	defer fabric.mu.Unlock()
 	if fabric.pools != nil {
-		fabric.pools[host] = cp
+		fabric.pools[key] = cp
 	}
 }
 
-// Atomically delete a connection pool for host
-func (fabric *Fabric) DeletePool(host string) {
+// Atomically delete a connection pool for key, user@host
+func (fabric *Fabric) DeletePool(key string) {
 	fabric.mu.Lock()
 	defer fabric.mu.Unlock()
 	if fabric.pools != nil {
-		delete(fabric.pools, host)
+		delete(fabric.pools, key)
 	}
 }
 
 func (fabric *Fabric) Close() {
+	fabric.mu.Lock()
+	programs := fabric.stopOrder()
+	fabric.programs = nil
+	fabric.mu.Unlock()
+	// programs are killed over pooled connections.
+	for _, p := range programs {
+		p.Kill(context.Background())
+	}
+
 	fabric.mu.Lock()
 	defer fabric.mu.Unlock()
 	for _, cp := range fabric.pools {
 		cp.Close()
 	}
-	for _, p := range fabric.programs {
-		p.Kill()
+	fabric.pools = nil
+}
+
+// Wait blocks until every started program has exited, including the
+// programs started, or restarted, while waiting.
+func (fabric *Fabric) Wait() {
+	for {
+		var running *Program
+		fabric.mu.Lock()
+		for _, p := range fabric.programs {
+			if !p.isDone() {
+				running = p
+				break
+			}
+		}
+		fabric.mu.Unlock()
+		if running == nil {
+			return
+		}
+		<-running.done
+	}
+}
+
+// Reload switches fabric to a new configuration without closing it.
+// `changes` are the programs that differ from current configuration, refer
+// api.DiffPrograms. Started programs that need a restart to pick up their
+// change are restarted and removed programs are killed, rest of them keep
+// running. Programs are restarted one after the other in the order of
+// their dependencies, each waiting for its dependencies to be ready, like
+// they are run. Programs that keep running keep the configuration they were
+// launched with, till their next launch. Connection pools are kept, except
+// for the ones whose ssh options have changed, and their idle connections
+// move to new pools when pool options change. Cancelling `ctx` stops
+// waiting for programs.
+// Programs failing to restart are reported to `printch`, and fail Reload
+// after the switch.
+func (fabric *Fabric) Reload(
+	ctx context.Context, config *api.Settings, changes []*api.ProgramChange,
+	printch outStr) (err error) {
+
+	if config == nil {
+		return fmt.Errorf("Configuration not loaded")
+	} else if err = config.Validate(); err != nil {
+		return err
+	}
+
+	fabric.mu.Lock()
+	old := fabric.Config
+	fabric.Config = config
+	poolChanged := old.SshPoolSize != config.SshPoolSize ||
+		old.SshPoolOverflow != config.SshPoolOverflow ||
+		old.SshPoolTimeout != config.SshPoolTimeout || old.SshPoolIdle != config.SshPoolIdle
+	for key, cp := range fabric.pools {
+		dialer, err := fabric.newDialer(cp.host, cp.username, 0)
+		if err != nil || !reflect.DeepEqual(dialer, cp.dialer) {
+			cp.Close()
+			delete(fabric.pools, key)
+		} else if poolChanged {
+			fabric.pools[key] = cp.handover(fabric.newPool(dialer))
+		}
+	}
+	fabric.mu.Unlock()
+
+	restarts := make([]string, 0, len(changes))
+	for _, change := range changes {
+		switch {
+		case change.Kind == api.PROGRAM_REMOVED:
+			fabric.KillProgram(ctx, change.Name)
+		case change.NeedsRestart() && fabric.GetProgram(change.Name) != nil:
+			restarts = append(restarts, change.Name)
+		}
+	}
+	restarts = config.StartOrder(restarts)
+	launches := make(map[string]*Launch)
+	for i := len(restarts) - 1; i >= 0; i-- {
+		fabric.KillProgram(ctx, restarts[i])
+		launches[restarts[i]] = NewLaunch()
+	}
+	results := fabric.Fanout(ctx, restarts, config.Parallelism, printch,
+		func(ctx context.Context, name string, ch chan<- string) (err error) {
+			defer func() { launches[name].Done(err) }()
+			if err = fabric.WaitDepends(ctx, name, launches, ch); err != nil {
+				return err
+			} else if _, err = fabric.RunProgram(name, printch); err != nil {
+				return err
+			}
+			return fabric.WaitReady(ctx, name)
+		})
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			printch <- fmt.Sprintf("%v%v\n", logPrefix(config.GetProgramConfig(res.Program)), res.Err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v programs failed to restart", failed, len(restarts))
 	}
-	fabric.pools, fabric.programs = nil, nil
+	return nil
 }
 
-func (fabric *Fabric) ExecRemoteCommand(cmd *remoteCommand, daemon bool) (err error) {
-	var client *ssh.ClientConn
+// ExecRemoteCommand runs `cmd` on its host, as a local process for the local
+// host, else over ssh. For `daemon` it returns once the command exits or
+// cmd.quit is closed. Failing to run the command, or cancelling `ctx`, is an
+// error, while its exit status, signal and output are in the result.
+func (fabric *Fabric) ExecRemoteCommand(
+	ctx context.Context, cmd *remoteCommand, daemon bool) (*ExecResult, error) {
+
+	return fabric.transport(cmd.host, cmd.user).exec(ctx, cmd, daemon)
+}
+
+// Exec executes `command` on `host` as `user`, with `environ`, streaming
+// its output to `printch`. Returned error is for failures other than the
+// command's exit status, refer ExecResult.Err.
+func (fabric *Fabric) Exec(
+	ctx context.Context, host, user string, environ api.Environ, command string,
+	printch outStr) (*ExecResult, error) {
+
+	return fabric.ExecRemoteCommand(ctx, &remoteCommand{
+		host:    host,
+		user:    user,
+		environ: environ,
+		command: command,
+		outch:   printch,
+		errch:   printch,
+	}, false)
+}
+
+// runCommand executes `cmd` to completion, failing for unsuccessful exit as
+// well.
+func (fabric *Fabric) runCommand(ctx context.Context, cmd *remoteCommand) (*ExecResult, error) {
+	res, err := fabric.ExecRemoteCommand(ctx, cmd, false)
+	if err == nil {
+		err = res.Err()
+	}
+	return res, err
+}
+
+// transport returns the transport to execute commands on `host` as `user`.
+func (fabric *Fabric) transport(host, user string) transport {
+	if isLocalHost(host, user) {
+		return localTransport{}
+	}
+	return sshTransport{fabric}
+}
+
+// sshTransport executes commands over pooled ssh connections.
+type sshTransport struct {
+	fabric *Fabric
+}
+
+func (t sshTransport) exec(
+	ctx context.Context, cmd *remoteCommand, daemon bool) (res *ExecResult, err error) {
+
+	var client *ssh.Client
 	var cp *connectionPool
+	var release func()
 
 	// Get connection pool for `host`
-	if cp, err = fabric.getConnectionPool(cmd.host, cmd.user); err != nil {
+	if cp, err = t.fabric.getConnectionPool(cmd.host, cmd.user); err != nil {
 		return
 	}
-	if client, err = cp.Get(); err != nil {
+	share := cp.Share
+	if cmd.control {
+		share = cp.ShareControl
+	}
+	if client, release, err = share(ctx); err != nil {
 		return
 	}
+	defer release()
 
 	// Get ssh session
-	session, _ := client.NewSession()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("%v@%v: %v", cmd.user, cmd.host, err)
+	}
+	defer session.Close()
 	stdin, stdout, stderr, err := remoteStandardio(session)
 	if err != nil {
 		return
@@ -145,108 +336,140 @@ func (fabric *Fabric) ExecRemoteCommand(cmd *remoteCommand, daemon bool) (err er
 		}
 	}
 
+	// Setup remote's environment
+	var command string
+	if command, err = setEnviron(cmd.environ, session, cmd.command); err != nil {
+		return
+	}
+
 	// Setup stdin, stdout & stderr readers
 	if cmd.inch != nil {
 		go writeIn(stdin, cmd.inch, cmd.errch)
 	}
-	if cmd.outch != nil {
-		go readOut(stdout, cmd.outch)
-	}
-	if cmd.errch != nil {
-		go readOut(stderr, cmd.errch)
-	}
+	res = newExecResult(cmd)
+	readers := res.capture(cmd, stdout, stderr)
 
-	// Setup remote's environment and run the command
-	if err = setEnviron(cmd.environ, session); err == nil {
-		if daemon {
-			go func() {
-				defer func() { recover() }()
-				err = session.Run(cmd.command)
-				close(cmd.quit)
-			}()
-			<-cmd.quit
-		} else {
-			err = session.Run(cmd.command)
-		}
-		if err != nil && cmd.errch != nil {
-			cmd.errch <- fmt.Sprintln(err)
-		}
+	// Run the command
+	if err = session.Start(command); err != nil {
+		return nil, err
 	}
-	session.Signal(ssh.SIGTERM)
-	session.Close()
-	cp.Return(client)
-	return
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	kill := func(sig ssh.Signal) { session.Signal(sig) }
+	err = res.wait(ctx, cmd, daemon, done, readers, kill)
+	return res, err
 }
 
-func (fabric *Fabric) MakeRemoteDirs(host, user, dir string, ch outStr) (err error) {
+func (fabric *Fabric) MakeRemoteDirs(
+	ctx context.Context, host, user, dir string, ch outStr) (err error) {
+
 	command := fmt.Sprintf("mkdir -p %v", dir)
 	ch <- fmt.Sprintf("Creating directory %q\n", dir)
 	cmd := &remoteCommand{
 		host: host, user: user, command: command, outch: ch, errch: ch}
-	err = fabric.ExecRemoteCommand(cmd, false)
+	_, err = fabric.runCommand(ctx, cmd)
 	return err
 }
 
-func (fabric *Fabric) RemoveRemoteDir(host, user, dir string, ch outStr) (err error) {
+func (fabric *Fabric) RemoveRemoteDir(
+	ctx context.Context, host, user, dir string, ch outStr) (err error) {
+
 	command := fmt.Sprintf("rm -rf %v", dir)
 	ch <- fmt.Sprintf("Removing directory %q\n", dir)
 	cmd := &remoteCommand{
 		host: host, user: user, command: command, outch: ch, errch: ch}
-	err = fabric.ExecRemoteCommand(cmd, false)
+	_, err = fabric.runCommand(ctx, cmd)
 	return err
 }
 
-func (fabric *Fabric) IsDir(host, user, dir string) bool {
-	command := fmt.Sprintf(`eval 'if [ -d %v ]; then echo "true"; else echo "false"; fi'`, dir)
-	ch := make(chan string)
-	cmd := &remoteCommand{host: host, user: user, command: command, outch: ch}
-	go func() {
-		fabric.ExecRemoteCommand(cmd, false)
-	}()
-	s, _ := <-ch
-	s = strings.Trim(s, "\n")
-	close(ch)
-	if s == "true" {
-		return true
+// IsDir tells whether `dir` is a directory on `host`.
+func (fabric *Fabric) IsDir(ctx context.Context, host, user, dir string) (bool, error) {
+	command := fmt.Sprintf("test -d %v", dir)
+	cmd := &remoteCommand{host: host, user: user, command: command}
+	res, err := fabric.ExecRemoteCommand(ctx, cmd, false)
+	switch {
+	case err != nil:
+		return false, err
+	case res.ExitStatus == 0:
+		return true, nil
+	case res.ExitStatus == 1 && res.Signal == "":
+		return false, nil
 	}
-	return false
+	return false, res.Err()
 }
 
 func (fabric *Fabric) Killall() {
 	fabric.mu.Lock()
-	defer fabric.mu.Unlock()
-	for _, p := range fabric.programs {
+	programs := fabric.stopOrder()
+	fabric.mu.Unlock()
+	for _, p := range programs {
 		if p != nil {
-			p.Kill()
+			p.Kill(context.Background())
 		}
 	}
 }
 
-func (fabric *Fabric) KillProgram(progname string) error {
+// stopOrder returns the started programs in the order to stop them, before
+// the programs they depend on. Must be called with mu locked.
+func (fabric *Fabric) stopOrder() []*Program {
+	names := make([]string, 0, len(fabric.programs))
+	for name := range fabric.programs {
+		names = append(names, name)
+	}
+	names = fabric.Config.StartOrder(names)
+	programs := make([]*Program, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		programs = append(programs, fabric.programs[names[i]])
+	}
+	return programs
+}
+
+// KillProgram kills started program `progname`, refer Program.Kill.
+// Cancelling `ctx` stops waiting for its processes to be gone.
+func (fabric *Fabric) KillProgram(ctx context.Context, progname string) error {
 	fabric.mu.Lock()
-	defer fabric.mu.Unlock()
-	if p := fabric.programs[progname]; p != nil {
-		p.Kill()
-		delete(fabric.programs, progname)
-		return nil
+	p := fabric.programs[progname]
+	delete(fabric.programs, progname)
+	fabric.mu.Unlock()
+	if p == nil {
+		return fmt.Errorf("Program name %v not found", progname)
 	}
-	return fmt.Errorf("Program name %v not found", progname)
+	return p.Kill(ctx)
 }
 
+// getConnectionPool returns the pool of connections to `host` as `user`,
+// pools are created on first use.
 func (fabric *Fabric) getConnectionPool(host, user string) (*connectionPool, error) {
-	cp := fabric.GetPool(host)
+	key := poolKey(host, user)
+	cp := fabric.GetPool(key)
 	if cp == nil {
-		poolSize := fabric.Config.SshPoolSize()
-		poolOverflow := fabric.Config.SshPoolOverflow()
-		cp = newConnectionPool(host, user, poolSize, poolOverflow)
+		dialer, err := fabric.newDialer(host, user, 0)
+		if err != nil {
+			return nil, err
+		}
+		cp = fabric.newPool(dialer)
 		if cp == nil {
 			return nil, fmt.Errorf("Unable to create pool for %v", host)
 		}
-		fabric.SetPool(host, cp)
+		fabric.SetPool(key, cp)
 	}
 	return cp, nil
 }
 
+// newPool returns a pool of connections made by `dialer`, with pool options
+// from current configuration.
+func (fabric *Fabric) newPool(dialer *sshDialer) *connectionPool {
+	poolSize := fabric.Config.SshPoolSize
+	poolOverflow := fabric.Config.SshPoolOverflow
+	timeout := time.Duration(fabric.Config.SshPoolTimeout) * time.Second
+	idleTimeout := time.Duration(fabric.Config.SshPoolIdle) * time.Second
+	return newConnectionPool(dialer, poolSize, poolOverflow, timeout, idleTimeout)
+}
+
+func poolKey(host, user string) string {
+	return user + "@" + host
+}
+
 func remoteStandardio(s *ssh.Session) (io.WriteCloser, io.Reader, io.Reader, error) {
 	var stdin io.WriteCloser
 	var stdout io.Reader
@@ -268,14 +491,71 @@ func remoteStandardio(s *ssh.Session) (io.WriteCloser, io.Reader, io.Reader, err
 	return stdin, stdout, stderr, nil
 }
 
-func setEnviron(environ api.Environ, session *ssh.Session) (err error) {
-	//if environ != nil {
-	//    for key, value := range environ {
-	//        if err = session.Setenv(key, value); err != nil {
-	//            fmt.Println(10, key, value)
-	//            return
-	//        }
-	//    }
-	//}
-	return
+// setEnviron sets `environ` for remote `command` and returns the command to
+// run in `session`. Literal values are set with Setenv, values referring to
+// remote variables, like "$HOME/go", and every value if sshd rejects Setenv,
+// typically for want of AcceptEnv, are exported by prefixing the command.
+// Exported values are expanded by the remote shell in the sorted order of
+// their names.
+func setEnviron(environ api.Environ, session *ssh.Session, command string) (string, error) {
+	names, err := envNames(environ)
+	if err != nil {
+		return "", err
+	}
+
+	exports := make([]string, 0)
+	for i, name := range names {
+		if strings.Contains(environ[name], "$") {
+			exports = append(exports, exportEnv(name, environ[name]))
+			continue
+		} else if err := session.Setenv(name, environ[name]); err == nil {
+			continue
+		}
+		// sshd rejects Setenv, export this and rest of them.
+		for _, name := range names[i:] {
+			exports = append(exports, exportEnv(name, environ[name]))
+		}
+		break
+	}
+	return strings.Join(exports, "") + command, nil
+}
+
+// envNames returns the validated names in `environ`, sorted.
+func envNames(environ api.Environ) ([]string, error) {
+	names := make([]string, 0, len(environ))
+	for name := range environ {
+		if !isEnvName(name) {
+			return nil, fmt.Errorf("Invalid environment variable %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// exportEnv returns shell statement to export variable `name` as `value`.
+func exportEnv(name, value string) string {
+	return fmt.Sprintf("export %v=%v; ", name, shellQuote(value, true))
+}
+
+// shellQuote double quotes `value` for a POSIX shell, leaving $VAR
+// references to be expanded if `expand`, else quoting them as well.
+func shellQuote(value string, expand bool) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", "$", `\$`)
+	if expand {
+		r = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	}
+	return `"` + r.Replace(value) + `"`
+}
+
+func isEnvName(name string) bool {
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return name != ""
 }
@@ -0,0 +1,32 @@
+package sshc
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	os.Setenv("CBSH_QUOTED", "expanded")
+	defer os.Unsetenv("CBSH_QUOTED")
+	testcases := []struct {
+		value    string
+		expand   bool
+		expected string
+	}{
+		{"plain", false, "plain"},
+		{`we$ird "q" 'x' \n ` + "`id`", false, `we$ird "q" 'x' \n ` + "`id`"},
+		{"$CBSH_QUOTED/dir", false, "$CBSH_QUOTED/dir"},
+		{"$CBSH_QUOTED/dir", true, "expanded/dir"},
+		{`"$CBSH_QUOTED" \ ` + "`id`", true, `"expanded" \ ` + "`id`"},
+		{"", true, ""},
+	}
+	for _, tc := range testcases {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(tc.value, tc.expand)).Output()
+		if err != nil {
+			t.Errorf("%q: %v", tc.value, err)
+		} else if string(out) != tc.expected {
+			t.Errorf("shellQuote(%q, %v) expected %q, got %q", tc.value, tc.expand, tc.expected, out)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package sshc
 
 import (
-	"code.google.com/p/go.crypto/ssh"
+	"context"
 	"errors"
-	"net"
-	"os"
+	"golang.org/x/crypto/ssh"
+	"sync"
 	"time"
 )
 
@@ -12,65 +12,116 @@ var errClosedPool = errors.New("the pool is closed")
 var errNoPool = errors.New("no pool")
 var errTimeout = errors.New("timeout")
 
-// Default timeout for retrieving a connection from the pool.
-var ConnPoolTimeout = time.Hour * 24 * 30
-
 // ConnPoolAvailWaitTime is the amount of time to wait for an existing
 // connection from the pool before considering the creation of a new
 // one.
 var ConnPoolAvailWaitTime = time.Millisecond
 
+// ConnPoolProbeTimeout is the amount of time to wait for a pooled
+// connection to reply to keepalive probe before reusing it.
+var ConnPoolProbeTimeout = 5 * time.Second
+
+// ConnMaxSessions is the number of sessions, and forwarded connections,
+// multiplexed at a time over a connection taken from the pool.
+var ConnMaxSessions = 8
+
+// ConnControlSessions is the number of sessions, beyond ConnMaxSessions,
+// kept on shared connections for control commands that kill programs, so
+// that they run without waiting for the pool. Together they are within the
+// default MaxSessions of 10 for sshd.
+var ConnControlSessions = 2
+
 type connectionPool struct {
 	host        string
 	username    string
-	connections chan *ssh.ClientConn
+	dialer      *sshDialer
+	connections chan *idleConn
 	createsem   chan bool
+	timeout     time.Duration // to get a connection
+	idleTimeout time.Duration // zero never evicts idle connections
+	quit        chan bool
+
+	mu      sync.Mutex
+	shared  []*sharedConn // connections taken from the pool by Share
+	getting bool          // a user of Share is getting a connection
+	freed   chan bool     // closed when shared connections change
 }
 
-func newConnectionPool(host, user string, poolSize, poolOverflow int) *connectionPool {
-	return &connectionPool{
-		host:        host,
-		username:    user,
-		connections: make(chan *ssh.ClientConn, poolSize),
-		createsem:   make(chan bool, poolSize+poolOverflow),
-	}
+// sharedConn is a connection taken from the pool that is shared by upto
+// ConnMaxSessions users, it goes back to the pool once all of them release
+// it.
+type sharedConn struct {
+	client *ssh.Client
+	users  int
 }
 
-// ConnPoolTimeout is notified whenever connections are acquired from a pool.
-var ConnPoolCallback func(host string, source string, start time.Time, err error)
+// idleConn is a connection waiting in the pool, since it was returned.
+type idleConn struct {
+	client *ssh.Client
+	since  time.Time
+}
 
-func mkConn(user, host string) (client *ssh.ClientConn, err error) {
-	// ssh-agent
-	agent_sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
-	if err != nil {
-		return nil, err
-	}
-	defer agent_sock.Close()
+func newConnectionPool(
+	dialer *sshDialer, poolSize, poolOverflow int, timeout, idleTimeout time.Duration) *connectionPool {
 
-	// ssh-client
-	config := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.ClientAuth{
-			ssh.ClientAuthAgent(ssh.NewAgentClient(agent_sock)),
-		},
+	cp := &connectionPool{
+		host:        dialer.host,
+		username:    dialer.user,
+		dialer:      dialer,
+		connections: make(chan *idleConn, poolSize),
+		createsem:   make(chan bool, poolSize+poolOverflow),
+		timeout:     timeout,
+		idleTimeout: idleTimeout,
+		quit:        make(chan bool),
+		freed:       make(chan bool),
 	}
-	dest := host + ":22"
-	if client, err = ssh.Dial("tcp", dest, config); err != nil {
-		return nil, err
+	if idleTimeout > 0 {
+		go cp.evictIdle()
 	}
-	return client, nil
+	return cp
 }
 
+// ConnPoolCallback is notified whenever connections are acquired from a
+// pool, with the pool's user@host. It defaults to recordPoolStats, refer
+// Fabric.PoolStats, chain it when setting a callback.
+var ConnPoolCallback func(host string, source string, start time.Time, err error)
+
 func (cp *connectionPool) Close() (err error) {
 	defer func() { err, _ = recover().(error) }()
+	close(cp.quit)
 	close(cp.connections)
-	for c := range cp.connections {
-		c.Close()
+	for ic := range cp.connections {
+		ic.client.Close()
 	}
 	return
 }
 
-func (cp *connectionPool) GetWithTimeout(d time.Duration) (rv *ssh.ClientConn, err error) {
+// handover closes the pool and moves its idle connections to pool `to`, as
+// many as `to` has room for, rest of them are closed. Connections in use are
+// closed once they are returned. Returns `to`.
+func (cp *connectionPool) handover(to *connectionPool) *connectionPool {
+	close(cp.quit)
+	close(cp.connections)
+	for ic := range cp.connections {
+		select {
+		case to.createsem <- true:
+			to.put(ic)
+		default:
+			ic.client.Close()
+		}
+	}
+	return to
+}
+
+func (cp *connectionPool) GetWithTimeout(d time.Duration) (rv *ssh.Client, err error) {
+	return cp.getContext(context.Background(), d)
+}
+
+// getContext gets a connection within `d`, giving up if `ctx` is cancelled
+// meanwhile.
+func (cp *connectionPool) getContext(
+	ctx context.Context, d time.Duration) (rv *ssh.Client, err error) {
+
 	if cp == nil {
 		return nil, errNoPool
 	}
@@ -79,19 +130,39 @@ func (cp *connectionPool) GetWithTimeout(d time.Duration) (rv *ssh.ClientConn, e
 
 	if ConnPoolCallback != nil {
 		defer func(path *string, start time.Time) {
-			ConnPoolCallback(cp.host, *path, start, err)
+			ConnPoolCallback(poolKey(cp.host, cp.username), *path, start, err)
 		}(&path, time.Now())
 	}
 
+	// Pooled connections that are dead, or idle for too long, are closed
+	// and acquiring is retried, till a live connection is picked or a new
+	// one is created.
+	deadline := time.Now().Add(d)
+	for {
+		var ic *idleConn
+		ic, path, err = cp.acquire(ctx, deadline.Sub(time.Now()))
+		if err != nil {
+			return nil, err
+		} else if path == "create" || cp.alive(ic) {
+			return ic.client, nil
+		}
+	}
+}
+
+// acquire picks an idle connection from the pool, or creates a new one,
+// within `d`. `path` tells how it was acquired.
+func (cp *connectionPool) acquire(
+	ctx context.Context, d time.Duration) (ic *idleConn, path string, err error) {
+
 	path = "short-circuit"
 
 	// short-circuit available connetions.
 	select {
-	case rv, isopen := <-cp.connections:
+	case ic, isopen := <-cp.connections:
 		if !isopen {
-			return nil, errClosedPool
+			return nil, path, errClosedPool
 		}
-		return rv, nil
+		return ic, path, nil
 	default:
 	}
 
@@ -100,74 +171,282 @@ func (cp *connectionPool) GetWithTimeout(d time.Duration) (rv *ssh.ClientConn, e
 
 	// Try to grab an available connection within 1ms
 	select {
-	case rv, isopen := <-cp.connections:
+	case ic, isopen := <-cp.connections:
 		path = "avail1"
 		if !isopen {
-			return nil, errClosedPool
+			return nil, path, errClosedPool
 		}
-		return rv, nil
+		return ic, path, nil
 	case <-t.C:
 		// No connection came around in time, let's see
 		// whether we can get one or build a new one first.
 		t.Reset(d) // Reuse the timer for the full timeout.
 		select {
-		case rv, isopen := <-cp.connections:
+		case ic, isopen := <-cp.connections:
 			path = "avail2"
 			if !isopen {
-				return nil, errClosedPool
+				return nil, path, errClosedPool
 			}
-			return rv, nil
+			return ic, path, nil
 		case cp.createsem <- true:
 			path = "create"
 			// Build a connection if we can't get a real one.
 			// This can potentially be an overflow connection, or
 			// a pooled connection.
-			rv, err := mkConn(cp.username, cp.host)
+			rv, err := cp.dialer.mkConn(ctx)
 			if err != nil {
 				// On error, release our create hold
 				<-cp.createsem
+				return nil, path, err
 			}
-			return rv, err
+			return &idleConn{client: rv}, path, nil
 		case <-t.C:
-			return nil, errTimeout
+			return nil, path, errTimeout
+		case <-ctx.Done():
+			return nil, path, ctx.Err()
+		}
+	}
+}
+
+// alive tells whether idle connection `ic` can be reused, that is it was
+// not idle for longer than idle timeout and replies to a keepalive probe.
+// Otherwise the connection is closed, releasing its place in the pool.
+func (cp *connectionPool) alive(ic *idleConn) bool {
+	if cp.idleTimeout > 0 && time.Since(ic.since) > cp.idleTimeout {
+		cp.discard(ic, POOL_EVICTED)
+		return false
+	} else if err := probe(ic.client, ConnPoolProbeTimeout); err != nil {
+		cp.discard(ic, POOL_DEAD)
+		return false
+	}
+	return true
+}
+
+// discard closes a connection taken out of the pool, for `reason`.
+func (cp *connectionPool) discard(ic *idleConn, reason string) {
+	countPoolStats(poolKey(cp.host, cp.username), reason)
+	ic.client.Close()
+	<-cp.createsem
+}
+
+// evictIdle closes connections idle for longer than idle timeout, checking
+// every half of idle timeout, till the pool is closed.
+func (cp *connectionPool) evictIdle() {
+	ticker := time.NewTicker(cp.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cp.quit:
+			return
+		case <-ticker.C:
+		}
+		// connections are picked from one end and put back on the other,
+		// visit each of them once.
+		for n := len(cp.connections); n > 0; n-- {
+			select {
+			case ic, isopen := <-cp.connections:
+				if !isopen {
+					return
+				} else if time.Since(ic.since) > cp.idleTimeout {
+					cp.discard(ic, POOL_EVICTED)
+				} else {
+					cp.put(ic)
+				}
+			default:
+				n = 0
+			}
 		}
 	}
 }
 
-func (cp *connectionPool) Get() (*ssh.ClientConn, error) {
-	return cp.GetWithTimeout(ConnPoolTimeout)
+func (cp *connectionPool) Get() (*ssh.Client, error) {
+	return cp.GetWithTimeout(cp.timeout)
 }
 
-func (cp *connectionPool) Hijack() (*ssh.ClientConn, error) {
+// GetContext is Get that gives up if `ctx` is cancelled.
+func (cp *connectionPool) GetContext(ctx context.Context) (*ssh.Client, error) {
+	return cp.getContext(ctx, cp.timeout)
+}
+
+// Share gets a connection to open a session, or forward a connection, on.
+// Connections are shared by upto ConnMaxSessions users, a new connection is
+// got from the pool only when all shared connections are busy, so that long
+// running sessions like those of programs do not hold the pool's
+// connections for themselves. Waits upto pool's timeout for a connection,
+// or for a shared connection to have room. `release` must be called once
+// done with the connection.
+func (cp *connectionPool) Share(
+	ctx context.Context) (client *ssh.Client, release func(), err error) {
+
+	return cp.share(ctx, ConnMaxSessions)
+}
+
+// ShareControl is Share for control commands, which may use the sessions
+// kept for them, refer ConnControlSessions.
+func (cp *connectionPool) ShareControl(
+	ctx context.Context) (client *ssh.Client, release func(), err error) {
+
+	return cp.share(ctx, ConnMaxSessions+ConnControlSessions)
+}
+
+// share gets a connection shared by less than `limit` users, refer Share.
+func (cp *connectionPool) share(
+	ctx context.Context, limit int) (client *ssh.Client, release func(), err error) {
+
+	if cp == nil {
+		return nil, nil, errNoPool
+	}
+	deadline := time.Now().Add(cp.timeout)
+	for {
+		cp.mu.Lock()
+		for _, sc := range cp.shared {
+			if sc.users < limit {
+				sc.users++
+				cp.mu.Unlock()
+				return sc.client, cp.releaser(sc), nil
+			}
+		}
+		freed, getting := cp.freed, cp.getting
+		cp.getting = true
+		cp.mu.Unlock()
+
+		if getting { // wait for the other user getting a connection.
+			t := time.NewTimer(deadline.Sub(time.Now()))
+			select {
+			case <-freed:
+				t.Stop()
+				continue
+			case <-t.C:
+				return nil, nil, errTimeout
+			case <-ctx.Done():
+				t.Stop()
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		// stop waiting for the pool once a shared connection has room.
+		gctx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-freed:
+				cancel()
+			case <-gctx.Done():
+			}
+		}()
+		client, err = cp.getContext(gctx, deadline.Sub(time.Now()))
+		cancel()
+		cp.mu.Lock()
+		cp.getting = false
+		var sc *sharedConn
+		if err == nil {
+			sc = &sharedConn{client: client, users: 1}
+			cp.shared = append(cp.shared, sc)
+		}
+		cp.signal()
+		cp.mu.Unlock()
+		if err == nil {
+			return client, cp.releaser(sc), nil
+		} else if err != context.Canceled || ctx.Err() != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// signal wakes up users waiting in Share, must be called with cp.mu
+// locked.
+func (cp *connectionPool) signal() {
+	close(cp.freed)
+	cp.freed = make(chan bool)
+}
+
+// releaser returns a function that releases shared connection `sc` once,
+// returning it to the pool when it has no more users.
+func (cp *connectionPool) releaser(sc *sharedConn) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cp.mu.Lock()
+			sc.users--
+			last := sc.users == 0
+			if last {
+				for i, other := range cp.shared {
+					if other == sc {
+						cp.shared = append(cp.shared[:i], cp.shared[i+1:]...)
+						break
+					}
+				}
+			}
+			cp.signal()
+			cp.mu.Unlock()
+			if last {
+				cp.Return(sc.client)
+			}
+		})
+	}
+}
+
+// sessions returns the number of users of shared connections.
+func (cp *connectionPool) sessions() (n int) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for _, sc := range cp.shared {
+		n += sc.users
+	}
+	return n
+}
+
+func (cp *connectionPool) Hijack() (*ssh.Client, error) {
 	client, err := cp.Get()
 	<-cp.createsem
 	return client, err
 }
 
-func (cp *connectionPool) Return(c *ssh.ClientConn) {
+func (cp *connectionPool) Return(c *ssh.Client) {
 	if c == nil {
 		return
 	}
 
 	if cp == nil {
 		c.Close()
+		return
 	}
+	cp.put(&idleConn{client: c, since: time.Now()})
+}
 
+// put places connection `ic` back in the pool, closing it if the pool is
+// full or closed.
+func (cp *connectionPool) put(ic *idleConn) {
 	defer func() {
 		if recover() != nil {
 			// This happens when the pool has already been
 			// closed and we're trying to return a
 			// connection to it anyway.  Just close the
 			// connection.
-			c.Close()
+			ic.client.Close()
 		}
 	}()
 
 	select {
-	case cp.connections <- c:
+	case cp.connections <- ic:
 	default:
 		// Overflow connection.
 		<-cp.createsem
-		c.Close()
+		ic.client.Close()
+	}
+}
+
+// probe sends a keepalive request to `client`, failing if the server does
+// not reply within `timeout`.
+func probe(client *ssh.Client, timeout time.Duration) error {
+	replych := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replych <- err
+	}()
+	select {
+	case err := <-replych:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
 	}
 }
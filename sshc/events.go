@@ -0,0 +1,43 @@
+package sshc
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxEvents is the number of recent events kept by fabric, older events are
+// dropped.
+const MaxEvents = 1000
+
+// Event is a notable happening in the lifecycle of a program, like its
+// restart.
+type Event struct {
+	Time    time.Time
+	Program string
+	Msg     string
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%v [%v] %v", e.Time.Format("15:04:05"), e.Program, e.Msg)
+}
+
+// Events returns the recent events of all programs, oldest first.
+func (fabric *Fabric) Events() []*Event {
+	fabric.statusMu.Lock()
+	defer fabric.statusMu.Unlock()
+	return append([]*Event(nil), fabric.events...)
+}
+
+// event records an event for program `p` and prints it along with program's
+// output.
+func (p *Program) event(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fabric := p.fabric
+	fabric.statusMu.Lock()
+	fabric.events = append(fabric.events, &Event{time.Now(), p.Name, msg})
+	if n := len(fabric.events); n > MaxEvents {
+		fabric.events = append(fabric.events[:0], fabric.events[n-MaxEvents:]...)
+	}
+	fabric.statusMu.Unlock()
+	p.Outch <- p.Sprintf("%v\n", msg)
+}
@@ -0,0 +1,84 @@
+package sshc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FanoutOp is an operation on program, or host, `prog`, like installing it,
+// that sends its output to `printch`.
+type FanoutOp func(ctx context.Context, prog string, printch chan<- string) error
+
+// FanoutResult is the outcome of a FanoutOp on a program, or host.
+type FanoutResult struct {
+	Program  string
+	Err      error
+	Duration time.Duration
+}
+
+// Fanout applies `op` on `programs` concurrently, upto `parallelism` of them
+// at a time. Output of each program is sent to `printch` prefixed with its
+// name, like Program.Sprintf. `programs` that are not configured are taken
+// as hosts, prefixed with plain names. Programs that did not start before
+// `ctx` is cancelled fail with ctx's error. Results are in the order of
+// `programs`.
+func (fabric *Fabric) Fanout(
+	ctx context.Context, programs []string, parallelism int,
+	printch outStr, op FanoutOp) []*FanoutResult {
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]*FanoutResult, len(programs))
+	sem := make(chan bool, parallelism)
+	var wg sync.WaitGroup
+	for i, prog := range programs {
+		results[i] = &FanoutResult{Program: prog}
+		select {
+		case sem <- true:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(res *FanoutResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			res.Err = fabric.fanoutOne(ctx, res.Program, printch, op)
+			res.Duration = time.Since(start)
+		}(results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// fanoutOne applies `op` on program `prog`, prefixing its output.
+func (fabric *Fabric) fanoutOne(
+	ctx context.Context, prog string, printch outStr, op FanoutOp) error {
+
+	prefix := fmt.Sprintf("[%v] ", prog)
+	if pconf := fabric.Config.GetProgramConfig(prog); pconf != nil {
+		prefix = logPrefix(pconf)
+	}
+	ch, done, drained := make(chan string), make(chan bool), make(chan bool)
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case s := <-ch:
+				printch <- prefix + s
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := op(ctx, prog, ch)
+	// ch is left open, output trailing behind a cancelled command must not
+	// send on a closed channel.
+	close(done)
+	<-drained
+	return err
+}
@@ -1,27 +1,51 @@
 package sshc
 
 import (
+	"context"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
 	"net/url"
-	"strings"
+	"time"
 )
 
-func (fabric *Fabric) InstallProgram(prog string, printch outStr, force bool) (err error) {
-	host := fabric.Config.TargetHost(prog)
-	repos := fabric.Config.Repository(prog)
-	environ := fabric.Config.ProgramEnviron(prog)
-	user := fabric.Config.User(prog)
-	for _, i := range repos {
-		repo := i.(api.Config)
-		target := repo["target"].(string)
-		fmt.Println(target)
-		if force || fabric.IsDir(host, user, target) == false {
-			err = fabric.CloneRepository(host, prog, repo, printch) // Clone
+// maxDiffSize limits the uncommitted changes patched on a cloned repository.
+const maxDiffSize = 16 * 1024 * 1024
+
+func (fabric *Fabric) InstallProgram(
+	ctx context.Context, prog string, printch outStr, force bool) (err error) {
+
+	pconf := fabric.Config.GetProgramConfig(prog)
+	if pconf == nil {
+		return fmt.Errorf("Program name %v not configured", prog)
+	}
+	// a started program is left in its state while being re-installed.
+	if fabric.setState(prog, nil, PROGRAM_INSTALLING, nil) {
+		defer func() {
+			if err != nil {
+				fabric.setState(prog, nil, PROGRAM_FAILED, func(st *ProgramStatus) {
+					st.Err = err
+				})
+			} else {
+				fabric.setState(prog, nil, PROGRAM_STOPPED, nil)
+			}
+		}()
+	}
+	host, environ, user := pconf.TargetHost, pconf.Environ, pconf.User
+	for _, repo := range pconf.Repository {
+		target := repo.Target
+		printch <- fmt.Sprintf("%v\n", target)
+		exists := false
+		if !force {
+			if exists, err = fabric.IsDir(ctx, host, user, target); err != nil {
+				return
+			}
+		}
+		if !exists {
+			err = fabric.CloneRepository(ctx, host, prog, repo, printch) // Clone
 			if err != nil {
 				return
 			}
-			err = fabric.PatchRepository(host, prog, repo, printch) // Patch
+			err = fabric.PatchRepository(ctx, host, prog, repo, printch) // Patch
 			if err != nil {
 				return
 			}
@@ -29,169 +53,164 @@ func (fabric *Fabric) InstallProgram(prog string, printch outStr, force bool) (e
 			printch <- fmt.Sprintf("target %q already exists\n", target)
 		}
 
-		if install_commands, ok := repo["install"].([]interface{}); ok {
-			for _, i := range install_commands { // Install
-				command := i.(string)
-				printch <- fmt.Sprintf("%v\n", command)
-				err = fabric.ExecRemoteCommand(&remoteCommand{
-					host:    host,
-					user:    user,
-					environ: environ,
-					command: command,
-					outch:   printch,
-					errch:   printch,
-				}, false)
+		for _, step := range repo.Install { // Install
+			err = fabric.runStep(ctx, host, user, environ, step, printch)
+			if err != nil { // rest of the steps depend on this one
+				return
 			}
 		}
 	}
 	return
 }
 
-func (fabric *Fabric) UninstallProgram(prog string, printch outStr) (err error) {
-	host := fabric.Config.TargetHost(prog)
-	repos := fabric.Config.Repository(prog)
-	environ := fabric.Config.ProgramEnviron(prog)
-	user := fabric.Config.User(prog)
-	for _, i := range repos {
-		repo := i.(api.Config)
-		target := repo["target"].(string)
-		err = fabric.RemoveRemoteDir(host, user, target, printch)
+func (fabric *Fabric) UninstallProgram(
+	ctx context.Context, prog string, printch outStr) (err error) {
+
+	pconf := fabric.Config.GetProgramConfig(prog)
+	if pconf == nil {
+		return fmt.Errorf("Program name %v not configured", prog)
+	}
+	host, environ, user := pconf.TargetHost, pconf.Environ, pconf.User
+	for _, repo := range pconf.Repository {
+		err = fabric.RemoveRemoteDir(ctx, host, user, repo.Target, printch)
 		if err != nil {
 			return
 		}
-		for _, i := range repo["uninstall"].([]interface{}) { // Uninstall
-			command := i.(string)
-			printch <- fmt.Sprintf("%v\n", command)
-			err = fabric.ExecRemoteCommand(&remoteCommand{
-				host:    host,
-				user:    user,
-				environ: environ,
-				command: command,
-				outch:   printch,
-				errch:   printch,
-			}, false)
+		for _, step := range repo.Uninstall { // Uninstall
+			err = fabric.runStep(ctx, host, user, environ, step, printch)
+			if err != nil {
+				return
+			}
 		}
 	}
 	return
 }
 
+// runStep runs an install or uninstall step, cancelling it if it does not
+// complete within the step's timeout.
+func (fabric *Fabric) runStep(
+	ctx context.Context, host, user string, environ api.Environ,
+	step api.InstallStep, printch outStr) (err error) {
+
+	printch <- fmt.Sprintf("%v\n", step.Command)
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		timeout := time.Duration(step.Timeout) * time.Second
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	_, err = fabric.runCommand(ctx, &remoteCommand{
+		host:    host,
+		user:    user,
+		environ: environ,
+		command: step.Command,
+		outch:   printch,
+		errch:   printch,
+	})
+	return
+}
+
 func (fabric *Fabric) CloneRepository(
-	host, progname string, repo api.Config, printch outStr) (err error) {
+	ctx context.Context, host, progname string, repo *api.RepositoryConfig, printch outStr) (err error) {
 
-	target, source := repo["target"].(string), repo["source"].(string)
-	user := fabric.Config.User(progname)
+	pconf := fabric.Config.GetProgramConfig(progname)
+	target, source, user := repo.Target, repo.Source, pconf.User
 
 	// Remove target repository
-	err = fabric.RemoveRemoteDir(host, user, target, printch)
+	err = fabric.RemoveRemoteDir(ctx, host, user, target, printch)
 	if err != nil {
 		return
 	}
 	// Create target repository
-	err = fabric.MakeRemoteDirs(host, user, target, printch)
+	err = fabric.MakeRemoteDirs(ctx, host, user, target, printch)
 	if err != nil {
 		return
 	}
 	// Clone repository from source to target
 	command := fmt.Sprintf("git clone --quiet %v %v", source, target)
 	printch <- fmt.Sprintf("%v\n", command)
-	err = fabric.ExecRemoteCommand(&remoteCommand{
+	_, err = fabric.runCommand(ctx, &remoteCommand{
 		host:    host,
 		user:    user,
-		environ: fabric.Config.ProgramEnviron(progname),
+		environ: pconf.Environ,
 		command: command,
 		outch:   printch,
 		errch:   printch,
-	}, false)
+	})
 	return
 }
 
 func (fabric *Fabric) PatchRepository(
-	host, progname string, repo api.Config, printch outStr) (err error) {
+	ctx context.Context, host, progname string, repo *api.RepositoryConfig, printch outStr) (err error) {
 
 	var diff string
-	if diff, err = fabric.DiffRepository(progname, repo, printch); err != nil {
+	if diff, err = fabric.DiffRepository(ctx, progname, repo, printch); err != nil {
 		return
 	} else if diff == "" {
 		return
 	}
 
-	target := repo["target"].(string)
+	pconf := fabric.Config.GetProgramConfig(progname)
 	inch := make(chan string)
-	command := fmt.Sprintf("cd %v; git apply -", target)
+	command := fmt.Sprintf("cd %v; git apply -", repo.Target)
 	printch <- fmt.Sprintf("%v\n", command)
 	go func() {
 		inch <- diff
 		close(inch)
 	}()
-	err = fabric.ExecRemoteCommand(&remoteCommand{
+	_, err = fabric.runCommand(ctx, &remoteCommand{
 		host:    host,
-		user:    fabric.Config.User(progname),
-		environ: fabric.Config.ProgramEnviron(progname),
+		user:    pconf.User,
+		environ: pconf.Environ,
 		command: command,
 		inch:    inch,
 		outch:   printch,
 		errch:   printch,
-	}, false)
+	})
 	return
 }
 
+// DiffRepository returns the uncommitted changes in source repository, as
+// `git diff`, to be patched on the cloned target. Sources with ssh:// scheme
+// are diffed on their host, local paths and file:// sources on the local
+// host, other sources have no working tree to diff.
 func (fabric *Fabric) DiffRepository(
-	prog string, repo api.Config, printch outStr) (string, error) {
+	ctx context.Context, prog string, repo *api.RepositoryConfig, printch outStr) (string, error) {
 
-	var host, path string
-	var user *url.Userinfo
+	var path string
+	var t transport
 	var err error
 	var u *url.URL
 
-	source := repo["source"].(string)
-	if u, err = url.Parse(source); err != nil {
+	if u, err = url.Parse(repo.Source); err != nil {
 		return "", err
 	}
-	if u.Scheme == "ssh" {
-		user, host, path = u.User, u.Host, u.Path
+	switch u.Scheme {
+	case "ssh":
+		path = u.Path
+		t = fabric.transport(u.Host, fabric.Config.GetProgramConfig(prog).User)
+	case "", "file":
+		path, t = u.Path, localTransport{}
+	default:
+		return "", nil
 	}
 
-	diffs := make([]string, 0)
-	if host != "" {
-		fabric.getConnectionPool(host, user.Username())
-		command := fmt.Sprintf("cd %v; git diff", path)
-		diffch := make(chan string)
-		errch := make(chan string)
-		q := make(chan bool)
-
-		go func() {
-			printch <- fmt.Sprintf("%v\n", command)
-			err = fabric.ExecRemoteCommand(&remoteCommand{
-				host:    host,
-				user:    fabric.Config.User(prog),
-				command: command,
-				outch:   diffch,
-				errch:   errch,
-			}, false)
-			if err != nil {
-				printch <- fmt.Sprintln(err)
-			}
-			close(q)
-		}()
-
-	loop:
-		for {
-			var s string
-			var ok bool
-			select {
-			case s, ok = <-diffch:
-				diffs = append(diffs, s)
-			case s, ok = <-errch:
-				printch <- s
-				break loop
-			case <-q:
-				break loop
-			}
-			if !ok {
-				break
-			}
-		}
-		return strings.Join(diffs, ""), err
+	command := fmt.Sprintf("cd %v; git diff", path)
+	printch <- fmt.Sprintf("%v\n", command)
+	res, err := t.exec(ctx, &remoteCommand{
+		host:    u.Host,
+		user:    fabric.Config.GetProgramConfig(prog).User,
+		command: command,
+		errch:   printch,
+		capture: maxDiffSize,
+	}, false)
+	if err == nil {
+		err = res.Err()
+	}
+	if err != nil {
+		return "", err
+	} else if res.Truncated {
+		return "", fmt.Errorf("Diff of %v is larger than %v bytes", repo.Source, maxDiffSize)
 	}
-	return "", fmt.Errorf("Cannot execute local commands")
+	return res.Stdout, nil
 }
@@ -0,0 +1,204 @@
+package sshc
+
+import (
+	"context"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// loginShell is the command for an interactive session, user's login shell.
+const loginShell = `exec "${SHELL:-/bin/sh}" -l`
+
+// Shell opens an interactive login shell on `host` as `user`, with `environ`
+// exported, attached to the terminal `in` and `out` till the shell exits or
+// `ctx` is cancelled. Programs on the local host get a local shell on a
+// pseudo terminal, refer isLocalHost.
+func (fabric *Fabric) Shell(
+	ctx context.Context, host, user string, environ api.Environ, in, out *os.File) error {
+
+	if !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return fmt.Errorf("Interactive shell needs a terminal")
+	}
+	t := &terminal{in: in, out: out}
+	if isLocalHost(host, user) {
+		return t.localShell(ctx, environ)
+	}
+
+	cp, err := fabric.getConnectionPool(host, user)
+	if err != nil {
+		return err
+	}
+	client, release, err := cp.Share(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("%v@%v: %v", user, host, err)
+	}
+	defer session.Close()
+	return t.sshShell(ctx, session, environ)
+}
+
+// terminal is the local terminal attached to an interactive shell.
+type terminal struct {
+	in  *os.File
+	out *os.File
+}
+
+func (t *terminal) size() (width, height int) {
+	width, height, err := term.GetSize(int(t.out.Fd()))
+	if err != nil {
+		return 80, 24
+	}
+	return width, height
+}
+
+func (t *terminal) sshShell(
+	ctx context.Context, session *ssh.Session, environ api.Environ) error {
+
+	width, height := t.size()
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = "xterm"
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return err
+	}
+	command, err := setEnviron(environ, session, loginShell)
+	if err != nil {
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	session.Stdout, session.Stderr = t.out, t.out
+	if err = session.Start(command); err != nil {
+		return err
+	}
+	resize := func(width, height int) { session.WindowChange(height, width) }
+	err = t.attach(ctx, stdin, resize, session.Wait, func() { session.Close() })
+	if _, ok := err.(*ssh.ExitError); ok { // status of last command in shell
+		return nil
+	}
+	return err
+}
+
+func (t *terminal) localShell(ctx context.Context, environ api.Environ) error {
+	names, err := envNames(environ)
+	if err != nil {
+		return err
+	}
+	exports := make([]string, 0, len(names))
+	for _, name := range names {
+		exports = append(exports, exportEnv(name, environ[name]))
+	}
+	c := exec.Command("/bin/sh", "-c", strings.Join(exports, "")+loginShell)
+	width, height := t.size()
+	ptmx, err := pty.StartWithSize(c, &pty.Winsize{Rows: uint16(height), Cols: uint16(width)})
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+	copied := make(chan bool)
+	go func() {
+		io.Copy(t.out, ptmx) // till the shell, and its children, close the pty
+		close(copied)
+	}()
+	resize := func(width, height int) {
+		pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(height), Cols: uint16(width)})
+	}
+	wait := func() error {
+		err := c.Wait()
+		<-copied
+		return err
+	}
+	err = t.attach(ctx, ptmx, resize, wait, func() { c.Process.Kill() })
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil
+	}
+	return err
+}
+
+// attach puts the terminal in raw mode, so that keys like ctrl-C reach the
+// shell, and copies its input to `stdin` and its size changes to `resize`
+// till `wait` returns. If `ctx` is cancelled meanwhile the shell is hung up.
+func (t *terminal) attach(
+	ctx context.Context, stdin io.Writer, resize func(width, height int),
+	wait func() error, hangup func()) error {
+
+	state, err := term.MakeRaw(int(t.in.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(t.in.Fd()), state)
+
+	done := make(chan bool)
+	defer close(done)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	go func() {
+		for {
+			select {
+			case <-winch:
+				resize(t.size())
+			case <-ctx.Done():
+				hangup()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	go io.Copy(stdin, &pollReader{f: t.in, done: done})
+	return wait()
+}
+
+// pollInterval is the interval, in milliseconds, to check whether reading
+// the terminal shall stop.
+const pollInterval = 100
+
+// pollReader reads `f` till `done` is closed, without leaving a read
+// pending after that, so that the shell's line editor gets the input that
+// follows.
+type pollReader struct {
+	f    *os.File
+	done chan bool
+}
+
+func (r *pollReader) Read(b []byte) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(r.f.Fd()), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		default:
+		}
+		n, err := unix.Poll(fds, pollInterval)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return 0, err
+		} else if n > 0 {
+			return r.f.Read(b)
+		}
+	}
+}
@@ -7,13 +7,25 @@ import (
 	"io"
 )
 
-func readOut(rd io.Reader, ch outStr) {
+// readOut sends lines read from `rd` to `ch`, till EOF or till `quit` is
+// closed, since nobody receives from `ch` after that.
+func readOut(rd io.Reader, ch outStr, quit <-chan bool) {
+	send := func(s string) bool {
+		select {
+		case ch <- s:
+			return true
+		case <-quit:
+			return false
+		}
+	}
 	r := bufio.NewReader(rd)
 	for {
 		if buf, err := r.ReadBytes(api.NEWLINE); len(buf) > 0 {
-			ch <- string(buf)
+			if !send(string(buf)) {
+				break
+			}
 		} else if err != nil && err != io.EOF {
-			ch <- fmt.Sprintf("%v", err)
+			send(fmt.Sprintf("%v", err))
 			break
 		} else {
 			break
@@ -0,0 +1,38 @@
+package sshc
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOutQuit(t *testing.T) {
+	ch, quit, done := make(chan string), make(chan bool), make(chan bool)
+	rd, wr := io.Pipe()
+	go func() {
+		readOut(rd, ch, quit)
+		close(done)
+	}()
+	go wr.Write([]byte("line1\nline2\n"))
+	if s := <-ch; s != "line1\n" {
+		t.Fatalf("expected line1, got %q", s)
+	}
+	close(quit) // nobody receives line2.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("readOut blocked after quit")
+	}
+
+	// without quit, every line is sent till EOF.
+	ch, done = make(chan string, 10), make(chan bool)
+	go func() {
+		readOut(strings.NewReader("line1\nline2"), ch, nil)
+		close(done)
+	}()
+	<-done
+	if len(ch) != 2 {
+		t.Errorf("expected 2 lines, got %v", len(ch))
+	}
+}
@@ -0,0 +1,245 @@
+package sshc
+
+import (
+	"context"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// killPollInterval is the interval to check whether signalled processes
+// are gone.
+const killPollInterval = 500 * time.Millisecond
+
+// processes are a group of processes on a host, to be signalled together.
+type processes struct {
+	desc string   // for messages, like "process group 123"
+	ids  []string // arguments to kill, pids or negated process group
+}
+
+// processGroup returns the process group `pgid`, or process `pid` alone if
+// the process group is not known.
+func processGroup(pid, pgid int) *processes {
+	if pgid > 0 {
+		return &processes{fmt.Sprintf("process group %v", pgid), []string{fmt.Sprintf("-%v", pgid)}}
+	}
+	return &processes{fmt.Sprintf("process %v", pid), []string{strconv.Itoa(pid)}}
+}
+
+// stopProcesses sends "kill.signals" of program `pconf`, one after the
+// other, to `procs` on its host till they are gone, waiting for
+// "kill.timeout" seconds after each signal. Closing `exited`, if not nil,
+// checks the processes right away. Every signal is reported to `report`.
+func (fabric *Fabric) stopProcesses(
+	ctx context.Context, pconf *api.ProgramConfig, procs *processes,
+	exited <-chan bool, report func(msg string)) error {
+
+	signals := pconf.KillSignals
+	if len(signals) == 0 {
+		signals = api.DefaultKillSignals
+	}
+	timeout := time.Duration(pconf.KillTimeout) * time.Second
+	for _, sig := range signals {
+		report(fmt.Sprintf("sending %v to %v", sig, procs.desc))
+		command := fmt.Sprintf("kill -%v %v", sig, strings.Join(procs.ids, " "))
+		if _, err := fabric.hostCommand(ctx, pconf, command); err != nil {
+			return err
+		}
+		gone, err := fabric.waitGone(ctx, pconf, procs, timeout, exited)
+		if err != nil {
+			return err
+		} else if gone {
+			return nil
+		}
+		exited = nil // already closed, or never closing
+	}
+	return fmt.Errorf("%v still running after %v", procs.desc, strings.Join(signals, ", "))
+}
+
+// waitGone polls, upto `timeout`, till `procs` are gone.
+func (fabric *Fabric) waitGone(
+	ctx context.Context, pconf *api.ProgramConfig, procs *processes,
+	timeout time.Duration, exited <-chan bool) (bool, error) {
+
+	command := aliveCommand(procs)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(killPollInterval)
+	defer ticker.Stop()
+	for {
+		res, err := fabric.hostCommand(ctx, pconf, command)
+		if err != nil {
+			return false, err
+		} else if res.ExitStatus == 1 {
+			return true, nil
+		} else if !res.Success() {
+			return false, res.Err()
+		}
+		select {
+		case <-exited:
+			exited = nil
+		case <-ticker.C:
+		case <-deadline.C:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// aliveCommand returns the command that exits 0 while atleast one of
+// `procs` is alive. Zombies, that are gone but not reaped by their parent,
+// are not alive. Hosts without ps count zombies as well.
+func aliveCommand(procs *processes) string {
+	ids := strings.Join(procs.ids, " ")
+	return fmt.Sprintf(`if command -v ps >/dev/null; then `+
+		`ps -e -o pid=,pgid=,stat= | awk -v ids=%q `+
+		`'BEGIN { n = split(ids, a, " "); for (i = 1; i <= n; i++) want[a[i]] = 1 } `+
+		`$3 !~ /^Z/ && (want[$1] || want["-" $2]) { alive = 1 } END { exit !alive }'; `+
+		`else for id in %v; do kill -0 $id 2>/dev/null && exit 0; done; exit 1; fi`,
+		ids, ids)
+}
+
+// Sweep kills stray processes of program `name` on its host, processes of
+// program's user that run program's executable, or the shell cbsh launches
+// it with, and do not belong to a started program, like the ones left
+// behind by an earlier cbsh. Processes are killed like Program.Kill, along
+// with their process group if they lead one. Returns the number of
+// processes signalled, stray processes and rest of their process groups.
+func (fabric *Fabric) Sweep(ctx context.Context, name string, printch outStr) (int, error) {
+	pconf := fabric.Config.GetProgramConfig(name)
+	if pconf == nil {
+		return 0, fmt.Errorf("Program name %v not configured", name)
+	}
+	res, err := fabric.hostCommand(ctx, pconf, `ps -u "$(id -u)" -o pid=,pgid=,args=`)
+	if err != nil {
+		return 0, err
+	} else if err = res.Err(); err != nil {
+		return 0, err
+	}
+	owned := fabric.startedGroups(pconf)
+	launched := launchedArgs(pconf.CommandLine())
+	listed := make([][]string, 0) // pid, pgid, args of every process
+	procs, pids, ids := &processes{}, []string{}, make(map[string]bool)
+	for _, line := range strings.Split(res.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		listed = append(listed, fields)
+		if owned[fields[1]] || !isProgramProcess(pconf, launched, fields[2:]) {
+			continue
+		}
+		pids = append(pids, fields[0])
+		id := fields[0]
+		if fields[0] == fields[1] { // along with its children
+			id = "-" + fields[1]
+		}
+		procs.ids, ids[id] = append(procs.ids, id), true
+	}
+	if len(pids) == 0 {
+		return 0, nil
+	}
+	signalled := 0
+	for _, fields := range listed {
+		if ids[fields[0]] || ids["-"+fields[1]] {
+			signalled++
+		}
+	}
+	procs.desc = fmt.Sprintf("stray processes %v", strings.Join(pids, " "))
+	report := func(msg string) { printch <- msg + "\n" }
+	return signalled, fabric.stopProcesses(ctx, pconf, procs, nil, report)
+}
+
+// launchedArgs returns the executable, and its arguments, launched by
+// `commandline`, that is the words of its last command without variable
+// assignments, exec and quotes. Quoted arguments having spaces are split.
+func launchedArgs(commandline string) []string {
+	commands := strings.FieldsFunc(commandline, func(r rune) bool {
+		return r == ';' || r == '&' || r == '|' || r == '\n'
+	})
+	for i := len(commands) - 1; i >= 0; i-- {
+		words := strings.Fields(commands[i])
+		for len(words) > 0 && (words[0] == "exec" || isAssignment(words[0])) {
+			words = words[1:]
+		}
+		if len(words) == 0 {
+			continue
+		}
+		for j, word := range words {
+			words[j] = strings.Trim(word, `"'`)
+		}
+		return words
+	}
+	return nil
+}
+
+func isAssignment(word string) bool {
+	i := strings.Index(word, "=")
+	return i > 0 && !strings.ContainsAny(word[:i], `"'/-$`)
+}
+
+// scriptInterpreters run the scripts launched by programs, listed by ps
+// before the script, like "/bin/sh ./indexer".
+var scriptInterpreters = regexp.MustCompile(`^(sh|bash|dash|ksh|zsh|perl|ruby|node|python[0-9.]*)$`)
+
+// isProgramProcess tells whether a process with arguments `args` belongs to
+// program `pconf`, that is its executable is the one `launched` by the
+// program, as path or by name, or a script run by its interpreter, with
+// program's arguments. Or it is the shell cbsh launches the program with,
+// identified by program's name, refer launchMarker.
+func isProgramProcess(pconf *api.ProgramConfig, launched, args []string) bool {
+	if len(args) == 0 || len(launched) == 0 {
+		return false
+	} else if cmdline := strings.Join(args, " "); strings.Contains(cmdline, pidMarker) {
+		return strings.Contains(cmdline, launchMarker(pconf.Name)+"$$:")
+	}
+	if len(args) > 1 && args[1] == launched[0] && scriptInterpreters.MatchString(path.Base(args[0])) {
+		args = args[1:]
+	}
+	if path.Base(args[0]) != path.Base(launched[0]) || len(args) < len(launched) {
+		return false
+	}
+	for i, arg := range launched[1:] {
+		if args[i+1] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+// startedGroups returns the process groups, and pids, of started programs
+// on the host of program `pconf`, as its user.
+func (fabric *Fabric) startedGroups(pconf *api.ProgramConfig) map[string]bool {
+	fabric.statusMu.Lock()
+	defer fabric.statusMu.Unlock()
+	owned := make(map[string]bool)
+	for name, st := range fabric.status {
+		other := fabric.Config.GetProgramConfig(name)
+		if other == nil || other.TargetHost != pconf.TargetHost || other.User != pconf.User {
+			continue
+		} else if st.State != PROGRAM_STARTING && st.State != PROGRAM_RUNNING {
+			continue
+		}
+		owned[strconv.Itoa(st.Pgid)], owned[strconv.Itoa(st.Pid)] = true, true
+	}
+	return owned
+}
+
+// hostCommand executes `command` on the host of program `pconf`, as its
+// user, capturing its output. It is a control command, so that programs
+// can be killed even when connections to the host are busy with sessions.
+func (fabric *Fabric) hostCommand(
+	ctx context.Context, pconf *api.ProgramConfig, command string) (*ExecResult, error) {
+
+	return fabric.ExecRemoteCommand(ctx, &remoteCommand{
+		host:    pconf.TargetHost,
+		user:    pconf.User,
+		command: command,
+		control: true,
+	}, false)
+}
@@ -0,0 +1,94 @@
+package sshc
+
+import (
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestLaunchedArgs(t *testing.T) {
+	testcases := []struct {
+		commandline string
+		launched    []string
+	}{
+		{"./indexer", []string{"./indexer"}},
+		{"cd /opt/cb/indexer; ./indexer -port 9102", []string{"./indexer", "-port", "9102"}},
+		{"cd /opt && exec ./indexer", []string{"./indexer"}},
+		{"GOMAXPROCS=4 LOG=debug /opt/bin/indexer", []string{"/opt/bin/indexer"}},
+		{"./indexer --log=debug", []string{"./indexer", "--log=debug"}},
+		{"./indexer 'a' \"b\" &", []string{"./indexer", "a", "b"}},
+		{"make build | tee log\n./indexer", []string{"./indexer"}},
+		{"", nil},
+		{";", nil},
+	}
+	for _, tc := range testcases {
+		launched := launchedArgs(tc.commandline)
+		if !reflect.DeepEqual(launched, tc.launched) {
+			t.Errorf("launchedArgs(%q): expected %q, got %q", tc.commandline, tc.launched, launched)
+		}
+	}
+}
+
+func TestIsProgramProcess(t *testing.T) {
+	pconf := &api.ProgramConfig{
+		Name:        "indexer",
+		Command:     "cd /opt/cb/indexer; ./indexer",
+		CommandArgs: []string{"-port", "9102"},
+	}
+	launched := launchedArgs(pconf.CommandLine())
+	testcases := []struct {
+		args    string
+		matched bool
+	}{
+		{"./indexer -port 9102", true},
+		{"/opt/cb/indexer/indexer -port 9102 -debug", true},
+		{"sh -c " + withPid("indexer", pconf.CommandLine()), true},
+		{`sh -c echo cbsh:pid:"indexer":$$:; cd /opt/cb/indexer; ./indexer -port 9102`, true},
+		// shells of other programs with indexer in their name or command.
+		{`sh -c echo cbsh:pid:"indexer2":$$:; cd /opt/cb/indexer; ./indexer -port 9102`, false},
+		{`sh -c echo cbsh:pid:"cbindexer":$$:; ./indexer`, false},
+		{`sh -c echo cbsh:pid:"projector":$$:; ./projector -indexer indexer`, false},
+		{"./indexer -port 9103", false},
+		{"./indexer", false},
+		{"./projector -port 9102", false},
+		{"/bin/sh ./indexer -port 9102", true},
+		{"python3 ./indexer -port 9102", true},
+		{"vi /opt/cb/indexer/indexer.go", false},
+		{"vi ./indexer -port 9102", false},
+		{"/bin/sh ./projector -port 9102", false},
+		{"sh -c cd /opt/cb/indexer; ./indexer -port 9102", false},
+		{"grep cd /opt/cb/indexer; ./indexer", false},
+		{"", false},
+	}
+	for _, tc := range testcases {
+		matched := isProgramProcess(pconf, launched, strings.Fields(tc.args))
+		if matched != tc.matched {
+			t.Errorf("isProgramProcess(%q): expected %v, got %v", tc.args, tc.matched, matched)
+		}
+	}
+}
+
+func TestAliveCommand(t *testing.T) {
+	self := os.Getpid()
+	testcases := []struct {
+		procs *processes
+		alive bool
+	}{
+		{processGroup(self, 0), true},
+		{processGroup(self, syscall.Getpgrp()), true},
+		{&processes{"processes", []string{"999999999", fmt.Sprint(self)}}, true},
+		{processGroup(999999999, 0), false},
+		{processGroup(999999999, 999999999), false},
+	}
+	for _, tc := range testcases {
+		err := exec.Command("sh", "-c", aliveCommand(tc.procs)).Run()
+		if alive := err == nil; alive != tc.alive {
+			t.Errorf("%v: expected alive %v, got %v (%v)", tc.procs.desc, tc.alive, alive, err)
+		}
+	}
+}
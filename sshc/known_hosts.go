@@ -0,0 +1,143 @@
+package sshc
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path"
+	"sync"
+)
+
+// knownHostsMu serializes reading and appending to known_hosts files.
+var knownHostsMu sync.Mutex
+
+// Result of looking up a host key in known_hosts.
+const (
+	hostKeyUnknown = iota
+	hostKeyMatch
+	hostKeyMismatch
+)
+
+// knownHosts verifies host keys against an OpenSSH known_hosts file, its
+// Check method is a ssh.HostKeyCallback. With api.SSH_HOSTKEY_TOFU, keys of
+// unknown hosts are appended to the file.
+type knownHosts struct {
+	file string
+	mode string
+}
+
+func (kh *knownHosts) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	name := knownhosts.Normalize(hostname)
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	result, want, err := kh.lookup(hostname, remote, key)
+	switch {
+	case err != nil:
+		return err
+	case result == hostKeyMatch:
+		return nil
+	case result == hostKeyMismatch:
+		return fmt.Errorf("Host key for %v has changed, refer %v:%v", name, want.Filename, want.Line)
+	case kh.mode == api.SSH_HOSTKEY_STRICT:
+		return fmt.Errorf("Host %v is not in %v", name, kh.file)
+	}
+	return kh.add(name, key)
+}
+
+// lookup returns whether `key` of host is known, along with a known key of
+// the host for a mismatch. A key of another type than the known keys is a
+// mismatch as well, else a server could downgrade to a type not pinned yet.
+func (kh *knownHosts) lookup(
+	hostname string, remote net.Addr, key ssh.PublicKey) (int, *knownhosts.KnownKey, error) {
+
+	wants, err := kh.knownKeys(hostname, remote, key)
+	if err != nil {
+		return hostKeyUnknown, nil, err
+	} else if wants == nil {
+		return hostKeyMatch, nil, nil
+	}
+	for i, want := range wants {
+		if want.Key.Type() == key.Type() {
+			return hostKeyMismatch, &wants[i], nil
+		}
+	}
+	if len(wants) > 0 {
+		return hostKeyMismatch, &wants[0], nil
+	}
+	return hostKeyUnknown, nil, nil
+}
+
+// knownKeys returns the keys known for host if they do not include `key`,
+// nil if they do and an empty list if the host is unknown.
+func (kh *knownHosts) knownKeys(
+	hostname string, remote net.Addr, key ssh.PublicKey) ([]knownhosts.KnownKey, error) {
+
+	if _, err := os.Stat(kh.file); os.IsNotExist(err) {
+		return []knownhosts.KnownKey{}, nil
+	}
+	callback, err := knownhosts.New(kh.file)
+	if err != nil {
+		return nil, err
+	}
+	err = callback(hostname, remote, key)
+	if err == nil {
+		return nil, nil
+	} else if keyErr, ok := err.(*knownhosts.KeyError); ok {
+		return append([]knownhosts.KnownKey{}, keyErr.Want...), nil
+	}
+	return nil, err
+}
+
+// noKey is a key no host has, to list the known keys of a host.
+var noKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// algorithms returns the host key algorithms for the key types known for
+// `hostname`, so that a known host negotiates one of its pinned keys, like
+// OpenSSH does. Returns nil, any algorithm, for unknown hosts.
+func (kh *knownHosts) algorithms(hostname string) ([]string, error) {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	wants, err := kh.knownKeys(hostname, &net.TCPAddr{IP: net.IPv4zero}, noKey)
+	if err != nil || len(wants) == 0 {
+		return nil, err
+	}
+	algos, seen := []string{}, map[string]bool{}
+	for _, want := range wants {
+		for _, algo := range keyAlgorithms(want.Key.Type()) {
+			if !seen[algo] {
+				algos, seen[algo] = append(algos, algo), true
+			}
+		}
+	}
+	return algos, nil
+}
+
+// keyAlgorithms returns the host key algorithms that use keys of `keyType`,
+// rsa keys sign with sha2 algorithms as well.
+func keyAlgorithms(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyType}
+}
+
+func (kh *knownHosts) add(name string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(path.Dir(kh.file), 0700); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(kh.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fmt.Fprintln(fd, knownhosts.Line([]string{name}, key))
+	return err
+}
@@ -0,0 +1,105 @@
+package sshc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/couchbaselabs/cbsh/api"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testHostKeys(t *testing.T) (ed, ed2, ec ssh.PublicKey) {
+	keys := []ssh.PublicKey{}
+	for i := 0; i < 2; i++ {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, _ := ssh.NewPublicKey(pub)
+		keys = append(keys, key)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, _ = ssh.NewPublicKey(&priv.PublicKey)
+	return keys[0], keys[1], ec
+}
+
+func TestKnownHostsCheck(t *testing.T) {
+	ed, ed2, ec := testHostKeys(t)
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	testcases := []struct {
+		mode  string
+		known ssh.PublicKey // pinned for host, nil for none
+		key   ssh.PublicKey
+		err   string
+		added bool
+	}{
+		{api.SSH_HOSTKEY_TOFU, nil, ed, "", true},
+		{api.SSH_HOSTKEY_TOFU, ed, ed, "", false},
+		{api.SSH_HOSTKEY_TOFU, ed, ed2, "has changed", false},
+		// a key of a type not pinned does not downgrade the host.
+		{api.SSH_HOSTKEY_TOFU, ed, ec, "has changed", false},
+		{api.SSH_HOSTKEY_STRICT, nil, ed, "is not in", false},
+		{api.SSH_HOSTKEY_STRICT, ed, ec, "has changed", false},
+	}
+	for i, tc := range testcases {
+		kh := &knownHosts{file: path.Join(t.TempDir(), "known_hosts"), mode: tc.mode}
+		if tc.known != nil {
+			if err := kh.add("host1", tc.known); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := kh.Check("host1:22", remote, tc.key)
+		if tc.err == "" && err != nil {
+			t.Errorf("%v: unexpected %v", i, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%v: expected %q, got %v", i, tc.err, err)
+		}
+		data, _ := ioutil.ReadFile(kh.file)
+		added := strings.Count(string(data), "\n")
+		if tc.known != nil {
+			added--
+		}
+		if (added == 1) != tc.added {
+			t.Errorf("%v: expected added %v, got %q", i, tc.added, data)
+		}
+	}
+}
+
+func TestKnownHostsAlgorithms(t *testing.T) {
+	ed, _, ec := testHostKeys(t)
+	kh := &knownHosts{file: path.Join(t.TempDir(), "known_hosts"), mode: api.SSH_HOSTKEY_TOFU}
+	if algos, err := kh.algorithms("host1:22"); err != nil || algos != nil {
+		t.Errorf("expected any algorithm without known_hosts, got %v %v", algos, err)
+	}
+	kh.add("host1", ed)
+	kh.add("host1", ec)
+	kh.add("host2", ec)
+	testcases := []struct {
+		hostname string
+		algos    []string
+	}{
+		{"host1:22", []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256}},
+		{"host2:22", []string{ssh.KeyAlgoECDSA256}},
+		{"host2:2022", nil},
+		{"host3:22", nil},
+	}
+	for _, tc := range testcases {
+		algos, err := kh.algorithms(tc.hostname)
+		if err != nil || !reflect.DeepEqual(algos, tc.algos) {
+			t.Errorf("%v: expected %v, got %v %v", tc.hostname, tc.algos, algos, err)
+		}
+	}
+	if algos := keyAlgorithms(ssh.KeyAlgoRSA); algos[0] != ssh.KeyAlgoRSASHA512 {
+		t.Errorf("expected sha2 algorithms for rsa keys, got %v", algos)
+	}
+}
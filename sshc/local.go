@@ -1 +1,102 @@
 package sshc
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+)
+
+// localTransport executes commands as local processes, with /bin/sh, so
+// that programs on the local host run without an sshd.
+type localTransport struct{}
+
+func (t localTransport) exec(
+	ctx context.Context, cmd *remoteCommand, daemon bool) (res *ExecResult, err error) {
+
+	names, err := envNames(cmd.environ)
+	if err != nil {
+		return nil, err
+	}
+	exports := make([]string, 0, len(names))
+	for _, name := range names {
+		exports = append(exports, exportEnv(name, cmd.environ[name]))
+	}
+	c := exec.Command("/bin/sh", "-c", strings.Join(exports, "")+cmd.command)
+	// own process group, to signal the shell along with its children.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if cmd.inch != nil {
+		var stdin io.WriteCloser
+		if stdin, err = c.StdinPipe(); err != nil {
+			return nil, err
+		}
+		go writeIn(stdin, cmd.inch, cmd.errch)
+	}
+	// Output is read from os pipes by the same readers as for ssh sessions,
+	// exec.Cmd does not copy it, and res.wait waits for the readers once
+	// the process exits, till children holding the pipes exit as well.
+	stdout, outw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, errw, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		outw.Close()
+		return nil, err
+	}
+	c.Stdout, c.Stderr = outw, errw
+	res = newExecResult(cmd)
+	readers := res.capture(cmd, stdout, stderr)
+	go func() {
+		readers.Wait()
+		stdout.Close()
+		stderr.Close()
+	}()
+	err = c.Start()
+	outw.Close() // child has its own copy
+	errw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	kill := func(sig ssh.Signal) { syscall.Kill(-c.Process.Pid, localSignals[sig]) }
+	err = res.wait(ctx, cmd, daemon, done, readers, kill)
+	return res, err
+}
+
+// localSignals maps signals sent to a command to local signals.
+var localSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGINT:  syscall.SIGINT,
+}
+
+// isLocalHost tells whether commands for `host` as `user` can run as local
+// processes, that is `host` is a loopback address, without a port, and
+// `user` is the current user.
+func isLocalHost(host, user string) bool {
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return CurrentUser() == user
+}
+
+// CurrentUser returns the name of user running cbsh, from $USER if it can
+// not be looked up.
+func CurrentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,90 @@
+package sshc
+
+import (
+	"strings"
+	"sync"
+)
+
+// Log is a bounded ring of the last lines of a program's output stream,
+// older lines are dropped once it is full.
+type Log struct {
+	mu      sync.Mutex
+	lines   []string
+	head    int       // index of the oldest line
+	size    int       // number of lines in the ring
+	total   int       // number of lines ever appended
+	changed chan bool // closed, and renewed, on every append
+}
+
+func newLog(maxsize int) *Log {
+	if maxsize < 1 {
+		maxsize = 1
+	}
+	return &Log{lines: make([]string, maxsize), changed: make(chan bool)}
+}
+
+// Append adds `line`, without its line ending, to the log.
+func (log *Log) Append(line string) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	line = strings.TrimRight(line, "\r\n")
+	if log.size < len(log.lines) {
+		log.lines[(log.head+log.size)%len(log.lines)] = line
+		log.size++
+	} else {
+		log.lines[log.head] = line
+		log.head = (log.head + 1) % len(log.lines)
+	}
+	log.total++
+	close(log.changed)
+	log.changed = make(chan bool)
+}
+
+// Since returns the lines appended after `seq` lines, that are still in the
+// log, oldest first. Since(0) returns every line in the log. `next` is the
+// seq for the lines that follow and `changed` is closed when they are
+// appended.
+func (log *Log) Since(seq int) (lines []string, next int, changed <-chan bool) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	oldest := log.total - log.size
+	if seq < oldest {
+		seq = oldest
+	}
+	for ; seq < log.total; seq++ {
+		lines = append(lines, log.lines[(log.head+seq-oldest)%len(log.lines)])
+	}
+	return lines, log.total, log.changed
+}
+
+// programLogs are the output streams of a program, kept across its
+// restarts.
+type programLogs struct {
+	stdout *Log
+	stderr *Log
+}
+
+// Logs returns the log of program `name`'s stdout, or its `stderr`, upto
+// "log.maxsize" lines. Logs of a program that did not start yet are empty.
+func (fabric *Fabric) Logs(name string, stderr bool) *Log {
+	logs := fabric.getLogs(name)
+	if stderr {
+		return logs.stderr
+	}
+	return logs.stdout
+}
+
+func (fabric *Fabric) getLogs(name string) *programLogs {
+	fabric.statusMu.Lock()
+	defer fabric.statusMu.Unlock()
+	if fabric.logs == nil {
+		fabric.logs = make(map[string]*programLogs)
+	}
+	logs, ok := fabric.logs[name]
+	if !ok {
+		maxsize := fabric.Config.LogMaxsize
+		logs = &programLogs{stdout: newLog(maxsize), stderr: newLog(maxsize)}
+		fabric.logs[name] = logs
+	}
+	return logs
+}
@@ -0,0 +1,69 @@
+package sshc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLogSince(t *testing.T) {
+	testcases := []struct {
+		maxsize  int
+		appended int
+		seq      int
+		lines    []string
+	}{
+		{3, 0, 0, nil},
+		{3, 2, 0, []string{"line0", "line1"}},
+		{3, 2, 1, []string{"line1"}},
+		{3, 2, 2, nil},
+		{3, 3, 0, []string{"line0", "line1", "line2"}},
+		// wrapped around, older lines are dropped.
+		{3, 5, 0, []string{"line2", "line3", "line4"}},
+		{3, 5, 3, []string{"line3", "line4"}},
+		{3, 7, 6, []string{"line6"}},
+		{3, 7, 7, nil},
+		{3, 100, 0, []string{"line97", "line98", "line99"}},
+		{1, 4, 0, []string{"line3"}},
+		{0, 4, 2, []string{"line3"}},
+	}
+	for _, tc := range testcases {
+		log := newLog(tc.maxsize)
+		for i := 0; i < tc.appended; i++ {
+			log.Append(fmt.Sprintf("line%v\r\n", i))
+		}
+		lines, next, _ := log.Since(tc.seq)
+		if !reflect.DeepEqual(lines, tc.lines) {
+			t.Errorf("maxsize %v, %v appended: Since(%v) expected %q, got %q",
+				tc.maxsize, tc.appended, tc.seq, tc.lines, lines)
+		} else if next != tc.appended {
+			t.Errorf("maxsize %v, %v appended: Since(%v) expected next %v, got %v",
+				tc.maxsize, tc.appended, tc.seq, tc.appended, next)
+		}
+	}
+}
+
+func TestLogFollow(t *testing.T) {
+	log := newLog(2)
+	log.Append("line0")
+	_, next, changed := log.Since(0)
+	select {
+	case <-changed:
+		t.Fatalf("changed before append")
+	default:
+	}
+	for i := 1; i <= 3; i++ { // more than the log keeps, since next
+		log.Append(fmt.Sprintf("line%v", i))
+	}
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("not changed after append")
+	}
+	lines, next, _ := log.Since(next)
+	if expected := []string{"line2", "line3"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %q, got %q", expected, lines)
+	} else if next != 4 {
+		t.Errorf("expected next 4, got %v", next)
+	}
+}
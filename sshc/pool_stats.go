@@ -0,0 +1,124 @@
+package sshc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons for closing a pooled connection, counted in PoolStats.
+const (
+	POOL_EVICTED = "evicted" // idle for longer than idle timeout
+	POOL_DEAD    = "dead"    // failed keepalive probe
+)
+
+// PoolStats are statistics of a connection pool, identified by user@host.
+// Counters are accumulated across pools for the same user@host.
+type PoolStats struct {
+	Key      string
+	Size     int // ssh.pool.size
+	InUse    int // connections handed out
+	Sessions int // sessions multiplexed over connections handed out
+	Idle     int // connections waiting in the pool
+	Overflow int // open connections beyond Size
+	Gets     int64
+	Creates  int64
+	Failures int64 // failed to get or create a connection
+	Evicted  int64
+	Dead     int64
+	WaitTime time.Duration // total time waited to get connections
+	MaxWait  time.Duration
+}
+
+// AvgWait returns the average time waited to get a connection.
+func (stats *PoolStats) AvgWait() time.Duration {
+	if stats.Gets == 0 {
+		return 0
+	}
+	return stats.WaitTime / time.Duration(stats.Gets)
+}
+
+var poolStatsMu sync.Mutex
+var poolStats = make(map[string]*PoolStats)
+
+// recordPoolStats is the default ConnPoolCallback, accumulating counters
+// for pool `key`.
+func recordPoolStats(key string, source string, start time.Time, err error) {
+	wait := time.Since(start)
+	poolStatsMu.Lock()
+	defer poolStatsMu.Unlock()
+	stats := getPoolStats(key)
+	stats.Gets++
+	stats.WaitTime += wait
+	if wait > stats.MaxWait {
+		stats.MaxWait = wait
+	}
+	if source == "create" && err == nil {
+		stats.Creates++
+	}
+	if err != nil {
+		stats.Failures++
+	}
+}
+
+// countPoolStats counts a connection of pool `key` closed for `reason`.
+func countPoolStats(key, reason string) {
+	poolStatsMu.Lock()
+	defer poolStatsMu.Unlock()
+	switch stats := getPoolStats(key); reason {
+	case POOL_EVICTED:
+		stats.Evicted++
+	case POOL_DEAD:
+		stats.Dead++
+	}
+}
+
+// getPoolStats must be called with poolStatsMu locked.
+func getPoolStats(key string) *PoolStats {
+	stats, ok := poolStats[key]
+	if !ok {
+		stats = &PoolStats{Key: key}
+		poolStats[key] = stats
+	}
+	return stats
+}
+
+// PoolStats returns statistics of open connection pools, sorted by
+// user@host.
+func (fabric *Fabric) PoolStats() []*PoolStats {
+	fabric.mu.Lock()
+	pools := make(map[string]*connectionPool)
+	for key, cp := range fabric.pools {
+		pools[key] = cp
+	}
+	fabric.mu.Unlock()
+
+	statss := make([]*PoolStats, 0, len(pools))
+	poolStatsMu.Lock()
+	for key, cp := range pools {
+		stats := *getPoolStats(key)
+		open, idle := len(cp.createsem), len(cp.connections)
+		stats.Size, stats.Idle = cap(cp.connections), idle
+		stats.Sessions = cp.sessions()
+		if stats.InUse = open - idle; stats.InUse < 0 {
+			stats.InUse = 0 // connection being discarded
+		}
+		if open > stats.Size {
+			stats.Overflow = open - stats.Size
+		}
+		statss = append(statss, &stats)
+	}
+	poolStatsMu.Unlock()
+	sort.Sort(poolStatsByKey(statss))
+	return statss
+}
+
+type poolStatsByKey []*PoolStats
+
+func (s poolStatsByKey) Len() int           { return len(s) }
+func (s poolStatsByKey) Less(i, j int) bool { return s[i].Key < s[j].Key }
+func (s poolStatsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func init() {
+	ConnPoolCallback = recordPoolStats
+}
@@ -1,41 +1,73 @@
 package sshc
 
 import (
+	"context"
 	"fmt"
 	"github.com/couchbaselabs/cbsh/api"
+	"regexp"
+	"sync"
+	"time"
 )
 
-type Log struct {
-	lines  []string
-	cursor int
-}
-
 type Program struct {
-	Name    string
-	Config  api.Config
-	Outch   chan<- string
-	Errch   chan<- string
-	fabric  *Fabric
-	outlog  *Log
-	errlog  *Log
-	quit    chan bool
-	healthy bool
+	Name   string
+	Config *api.ProgramConfig // launched with, it does not change on reload
+	Outch  chan<- string
+	Errch  chan<- string
+	fabric *Fabric
+	outlog *Log // refer Fabric.Logs
+	errlog *Log
+	quit   chan bool // closed once the program stops running
+	killed chan bool // closed when killed by cbsh
+	done   chan bool // closed once the program stopped and is not restarting
+
+	ready     chan bool // closed once the program is ready, refer WaitReady
+	readyOnce sync.Once
+	readyLog  *regexp.Regexp // for "ready.log" probe
+
+	started time.Time
+	retries int // restarts in a row, by restart policy, that started this
 }
 
 func (fabric *Fabric) RunProgram(name string, printch outStr) (*Program, error) {
-	logMaxSize := fabric.Config.LogMaxsize()
+	return fabric.startProgram(name, printch, 0)
+}
+
+// startProgram launches program `name`, `retries` is the number of
+// restarts in a row that led to this start, refer Program.restartAfter.
+func (fabric *Fabric) startProgram(
+	name string, printch outStr, retries int) (*Program, error) {
+
+	pconf := fabric.Config.GetProgramConfig(name)
+	if pconf == nil {
+		return nil, fmt.Errorf("Program name %v not configured", name)
+	}
+	logs := fabric.getLogs(name)
 	// construct the program structure
 	program := Program{
 		Name:    name,
-		Config:  fabric.Config,
+		Config:  pconf,
 		Outch:   printch,
 		Errch:   printch,
 		fabric:  fabric,
-		outlog:  &Log{lines: make([]string, logMaxSize)},
-		errlog:  &Log{lines: make([]string, logMaxSize)},
+		outlog:  logs.stdout,
+		errlog:  logs.stderr,
 		quit:    make(chan bool),
-		healthy: true,
+		killed:  make(chan bool),
+		done:    make(chan bool),
+		ready:   make(chan bool),
+		started: time.Now(),
+		retries: retries,
 	}
+	if probe := pconf.Ready; probe != nil && probe.Log != "" {
+		program.readyLog = regexp.MustCompile(probe.Log) // validated
+	}
+	fabric.setState(name, &program, PROGRAM_STARTING, func(st *ProgramStatus) {
+		if !st.Started.IsZero() {
+			st.Restarts++
+		}
+		st.Started, st.Pid, st.Pgid, st.Err = program.started, 0, 0, nil
+	})
 	fabric.SetProgram(name, &program)
 	go program.runProgram()
 	return &program, nil
@@ -44,21 +76,36 @@ func (fabric *Fabric) RunProgram(name string, printch outStr) (*Program, error)
 func (p *Program) runProgram() (err error) {
 	chout := make(chan string)
 	cherr := make(chan string)
+	probe := p.Config.Ready
+	if probe != nil && probe.Log == "" {
+		go p.probe(probe)
+	}
 	go func() {
 		var s string
 		var ok bool
+		started := false // reported pid
 	loop:
 		for {
 			select {
 			case s, ok = <-chout:
-				if ok {
-					p.appendLog(p.outlog, s)
+				if pid, pgid, isPid := parsePid(s); ok && isPid && !started {
+					started = true
+					p.fabric.setState(p.Name, p, PROGRAM_RUNNING, func(st *ProgramStatus) {
+						st.Pid, st.Pgid = pid, pgid
+					})
+					if probe == nil {
+						p.setReady()
+					}
+				} else if ok {
+					p.outlog.Append(s)
 					p.Outch <- p.Sprintf("%v", s)
+					p.matchReady(s)
 				}
 			case s, ok = <-cherr:
 				if ok {
-					p.appendLog(p.errlog, s)
+					p.errlog.Append(s)
 					p.Errch <- p.Sprintf("%v", s)
+					p.matchReady(s)
 				}
 			case <-p.quit:
 				ok = false
@@ -68,65 +115,209 @@ func (p *Program) runProgram() (err error) {
 			}
 		}
 	}()
-	err = p.fabric.ExecRemoteCommand(&remoteCommand{
-		host:    p.Config.TargetHost(p.Name),
-		user:    p.Config.User(p.Name),
-		environ: p.Config.ProgramEnviron(p.Name),
-		command: p.Config.ProgramCommand(p.Name),
+	// program lives till it is killed, not bound to the command that ran it.
+	res, err := p.fabric.ExecRemoteCommand(context.Background(), &remoteCommand{
+		host:    p.Config.TargetHost,
+		user:    p.Config.User,
+		environ: p.Config.Environ,
+		command: withPid(p.Name, p.Config.CommandLine()),
 		outch:   chout,
 		errch:   cherr,
 		quit:    p.quit,
 	}, true)
+	p.exited(res, err)
 	p.Close()
+	p.supervise(res, err)
+	close(p.done)
 	return
 }
 
-func (p *Program) Kill() {
+// supervise restarts the program after it stopped running, if its restart
+// policy says so, refer restartAfter. Waiting to restart is cancelled by
+// killing the program.
+func (p *Program) supervise(res *ExecResult, err error) {
+	delay, ok := p.restartAfter(res, err)
+	if !ok {
+		return
+	}
+	at := time.Now().Add(delay)
+	moved := p.fabric.setState(p.Name, p, PROGRAM_RESTARTING, func(st *ProgramStatus) {
+		st.Restart = at
+	})
+	if !moved { // killed, or started again, meanwhile
+		return
+	}
+	p.event("%v, restarting in %v, retry %v", p.stopReason(res, err), delay, p.retryOf())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.killed:
+		p.fabric.setState(p.Name, p, PROGRAM_KILLED, nil)
+		p.event("restart cancelled")
+		return
+	}
+	if p.fabric.GetProgram(p.Name) != p { // replaced, or fabric is closed
+		return
+	}
+	if _, err := p.fabric.startProgram(p.Name, p.Outch, p.retries+1); err != nil {
+		p.event("restart failed: %v", err)
+	}
+}
+
+// restartAfter tells whether the program shall be restarted, after it
+// stopped running with `res` and `err`, and how long to wait before that.
+// Wait starts with "restart.backoff" and doubles for every restart in a
+// row, upto "restart.maxbackoff". A program that ran longer than
+// "restart.maxbackoff" starts afresh.
+func (p *Program) restartAfter(res *ExecResult, err error) (time.Duration, bool) {
+	pconf := p.Config
+	select {
+	case <-p.killed:
+		return 0, false
+	default:
+	}
+	switch pconf.Restart {
+	case api.RESTART_ALWAYS:
+	case api.RESTART_ON_FAILURE:
+		if err == nil && res.Success() {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	maxBackoff := time.Duration(pconf.RestartMaxBackoff) * time.Second
+	if time.Since(p.started) > maxBackoff {
+		p.retries = 0
+	}
+	if pconf.RestartMaxRetries > 0 && p.retries >= pconf.RestartMaxRetries {
+		p.event("%v, giving up after %v restarts", p.stopReason(res, err), p.retries)
+		return 0, false
+	}
+	delay := time.Duration(pconf.RestartBackoff) * time.Second
+	for i := 0; i < p.retries && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay, true
+}
+
+// stopReason describes how the program stopped running.
+func (p *Program) stopReason(res *ExecResult, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("failed: %v", err)
+	case res.Signal != "":
+		return fmt.Sprintf("exited(%v)", res.Signal)
+	}
+	return fmt.Sprintf("exited(%v)", res.ExitStatus)
+}
+
+// retryOf describes the next restart along with the retry limit.
+func (p *Program) retryOf() string {
+	if max := p.Config.RestartMaxRetries; max > 0 {
+		return fmt.Sprintf("%v of %v", p.retries+1, max)
+	}
+	return fmt.Sprintf("%v", p.retries+1)
+}
+
+// matchReady marks the program as ready when its output `line` matches
+// "ready.log" probe.
+func (p *Program) matchReady(line string) {
+	if p.readyLog != nil && p.readyLog.MatchString(line) {
+		p.setReady()
+	}
+}
+
+// exited records how the program stopped running, a killed program stays
+// killed.
+func (p *Program) exited(res *ExecResult, err error) {
+	now := time.Now()
+	if err != nil {
+		p.fabric.setState(p.Name, p, PROGRAM_FAILED, func(st *ProgramStatus) {
+			st.Err, st.Stopped = err, now
+		})
+		return
+	}
+	p.fabric.setState(p.Name, p, PROGRAM_EXITED, func(st *ProgramStatus) {
+		st.ExitCode, st.Signal, st.Stopped = res.ExitStatus, res.Signal, now
+	})
+}
+
+// Kill stops the program by signalling its process group on the remote
+// host, refer stopProcesses, and returns once the processes are gone. A
+// program that stopped, or has not reported its pid yet, is only hung up.
+func (p *Program) Kill(ctx context.Context) error {
 	p.Outch <- p.Sprintf("Getting Killed\n")
-	p.Close()
+	func() {
+		defer func() { recover() }()
+		close(p.killed)
+	}()
+	now := time.Now()
+	p.fabric.setState(p.Name, p, PROGRAM_KILLED, func(st *ProgramStatus) {
+		st.Stopped = now
+	})
+	defer p.Close()
+	select {
+	case <-p.quit:
+		return nil
+	default:
+	}
+	pid, pgid := p.fabric.programPid(p)
+	if pid == 0 {
+		return nil
+	}
+	report := func(msg string) { p.event("%v", msg) }
+	err := p.fabric.stopProcesses(ctx, p.Config, processGroup(pid, pgid), p.quit, report)
+	if err != nil {
+		return fmt.Errorf("%v: %v", p.Name, err)
+	}
+	return nil
 }
 
 func (p *Program) Close() {
 	defer func() { recover() }()
 	close(p.quit)
-	p.healthy = true
+}
+
+// isDone tells whether the program has stopped running and is not waiting
+// to restart.
+func (p *Program) isDone() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (p *Program) Sprintf(format string, args ...interface{}) string {
-	var prefix string
-	colorstr := p.Config.LogColor(p.Name)
-	switch colorstr {
+	return logPrefix(p.Config) + fmt.Sprintf(format, args...)
+}
+
+// logPrefix returns the prefix for program's output, its name colored with
+// "log.color".
+func logPrefix(pconf *api.ProgramConfig) string {
+	switch pconf.LogColor {
 	case "black":
-		prefix = fmt.Sprintf("[%v] ", api.Black(p.Name))
+		return fmt.Sprintf("[%v] ", api.Black(pconf.Name))
 	case "red":
-		prefix = fmt.Sprintf("[%v] ", api.Red(p.Name))
+		return fmt.Sprintf("[%v] ", api.Red(pconf.Name))
 	case "green":
-		prefix = fmt.Sprintf("[%v] ", api.Green(p.Name))
+		return fmt.Sprintf("[%v] ", api.Green(pconf.Name))
 	case "blue":
-		prefix = fmt.Sprintf("[%v] ", api.Blue(p.Name))
+		return fmt.Sprintf("[%v] ", api.Blue(pconf.Name))
 	case "magenta":
-		prefix = fmt.Sprintf("[%v] ", api.Magenta(p.Name))
+		return fmt.Sprintf("[%v] ", api.Magenta(pconf.Name))
 	case "cyan":
-		prefix = fmt.Sprintf("[%v] ", api.Cyan(p.Name))
+		return fmt.Sprintf("[%v] ", api.Cyan(pconf.Name))
 	case "white":
-		prefix = fmt.Sprintf("[%v] ", api.White(p.Name))
+		return fmt.Sprintf("[%v] ", api.White(pconf.Name))
 	case "yellow":
-		prefix = fmt.Sprintf("[%v] ", api.Yellow(p.Name))
-	default:
-		prefix = fmt.Sprintf("[%v] ", p.Name)
-	}
-	s := fmt.Sprintf(format, args...)
-	return prefix + s
-}
-
-func (p *Program) appendLog(log *Log, s string) {
-	maxsize := p.Config.LogMaxsize()
-	l := len(log.lines)
-	if len(log.lines) >= maxsize {
-		copy(log.lines[1:], log.lines[:l-1])
-		log.lines[0] = s
-	}
-	if log.cursor < (maxsize - 1) {
-		log.cursor += 1
+		return fmt.Sprintf("[%v] ", api.Yellow(pconf.Name))
 	}
+	return fmt.Sprintf("[%v] ", pconf.Name)
 }
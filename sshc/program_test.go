@@ -0,0 +1,73 @@
+package sshc
+
+import (
+	"errors"
+	"github.com/couchbaselabs/cbsh/api"
+	"testing"
+	"time"
+)
+
+func TestRestartAfter(t *testing.T) {
+	failed, exited := &ExecResult{ExitStatus: 1}, &ExecResult{}
+	testcases := []struct {
+		restart    string
+		maxretries int
+		backoff    int
+		maxbackoff int
+		res        *ExecResult
+		err        error
+		retries    int
+		ranFor     time.Duration
+		killed     bool
+		delay      time.Duration
+		restarted  bool
+	}{
+		{api.RESTART_NEVER, 0, 1, 60, failed, nil, 0, 0, false, 0, false},
+		{api.RESTART_ON_FAILURE, 0, 1, 60, exited, nil, 0, 0, false, 0, false},
+		{api.RESTART_ON_FAILURE, 0, 1, 60, failed, nil, 0, 0, false, time.Second, true},
+		{api.RESTART_ON_FAILURE, 0, 1, 60, nil, errors.New("x"), 0, 0, false, time.Second, true},
+		{api.RESTART_ON_FAILURE, 0, 1, 60, &ExecResult{Signal: "KILL"}, nil, 0, 0, false,
+			time.Second, true},
+		{api.RESTART_ALWAYS, 0, 1, 60, exited, nil, 0, 0, false, time.Second, true},
+		{api.RESTART_ALWAYS, 0, 1, 60, exited, nil, 0, 0, true, 0, false},
+		// backoff doubles for every restart in a row, upto maxbackoff.
+		{api.RESTART_ALWAYS, 0, 1, 60, failed, nil, 1, 0, false, 2 * time.Second, true},
+		{api.RESTART_ALWAYS, 0, 1, 60, failed, nil, 3, 0, false, 8 * time.Second, true},
+		{api.RESTART_ALWAYS, 0, 1, 60, failed, nil, 6, 0, false, 60 * time.Second, true},
+		{api.RESTART_ALWAYS, 0, 1, 60, failed, nil, 100, 0, false, 60 * time.Second, true},
+		{api.RESTART_ALWAYS, 0, 5, 12, failed, nil, 1, 0, false, 10 * time.Second, true},
+		{api.RESTART_ALWAYS, 0, 5, 12, failed, nil, 2, 0, false, 12 * time.Second, true},
+		{api.RESTART_ALWAYS, 0, 0, 60, failed, nil, 3, 0, false, 0, true},
+		// ran longer than maxbackoff, starts afresh.
+		{api.RESTART_ALWAYS, 0, 1, 10, failed, nil, 5, 11 * time.Second, false, time.Second, true},
+		{api.RESTART_ALWAYS, 3, 1, 10, failed, nil, 3, 11 * time.Second, false, time.Second, true},
+		// gives up after maxretries in a row.
+		{api.RESTART_ALWAYS, 3, 1, 60, failed, nil, 2, 0, false, 4 * time.Second, true},
+		{api.RESTART_ALWAYS, 3, 1, 60, failed, nil, 3, 0, false, 0, false},
+	}
+	for i, tc := range testcases {
+		outch := make(chan string, 10)
+		p := &Program{
+			Name: "p",
+			Config: &api.ProgramConfig{
+				Name:              "p",
+				Restart:           tc.restart,
+				RestartMaxRetries: tc.maxretries,
+				RestartBackoff:    tc.backoff,
+				RestartMaxBackoff: tc.maxbackoff,
+			},
+			Outch:   outch,
+			fabric:  &Fabric{},
+			killed:  make(chan bool),
+			started: time.Now().Add(-tc.ranFor),
+			retries: tc.retries,
+		}
+		if tc.killed {
+			close(p.killed)
+		}
+		delay, restarted := p.restartAfter(tc.res, tc.err)
+		if delay != tc.delay || restarted != tc.restarted {
+			t.Errorf("case %v: expected %v, %v got %v, %v", i, tc.delay, tc.restarted, delay, restarted)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package sshc
+
+import (
+	"context"
+	"fmt"
+	"github.com/couchbaselabs/cbsh/api"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WaitReady waits till program `name`, that was launched, is ready, refer
+// api.ReadyProbe, for upto "ready.timeout" seconds.
+func (fabric *Fabric) WaitReady(ctx context.Context, name string) error {
+	p := fabric.GetProgram(name)
+	if p == nil {
+		return fmt.Errorf("Program %v is not running", name)
+	}
+	return p.waitReady(ctx)
+}
+
+// Launch is the outcome of launching a program, for the programs that
+// depend on it, refer WaitDepends.
+type Launch struct {
+	done chan bool
+	err  error // valid once done is closed
+}
+
+// NewLaunch returns the outcome of a program yet to be launched.
+func NewLaunch() *Launch {
+	return &Launch{done: make(chan bool)}
+}
+
+// Done records the outcome of launching the program, `err` if it failed.
+func (l *Launch) Done(err error) {
+	l.err = err
+	close(l.done)
+}
+
+// WaitDepends waits for the programs that program `name` depends on to be
+// launched, if they are in `launches`, and ready.
+func (fabric *Fabric) WaitDepends(
+	ctx context.Context, name string, launches map[string]*Launch, printch outStr) error {
+
+	pconf := fabric.Config.GetProgramConfig(name)
+	if pconf == nil || len(pconf.DependsOn) == 0 {
+		return nil
+	}
+	printch <- fmt.Sprintf("waiting for %v\n", strings.Join(pconf.DependsOn, ", "))
+	for _, dep := range pconf.DependsOn {
+		if l, ok := launches[dep]; ok {
+			select {
+			case <-l.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if l.err != nil {
+				return fmt.Errorf("Dependency %v failed to run", dep)
+			}
+		} else if err := fabric.WaitReady(ctx, dep); err != nil {
+			return fmt.Errorf("Dependency %v: %v", dep, err)
+		}
+	}
+	return nil
+}
+
+func (p *Program) waitReady(ctx context.Context) error {
+	select {
+	case <-p.ready: // even if it has stopped since
+		return nil
+	default:
+	}
+	timeout := api.DefaultReadyTimeout * time.Second
+	if probe := p.Config.Ready; probe != nil {
+		timeout = time.Duration(probe.Timeout) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.ready:
+		return nil
+	case <-p.quit:
+		return fmt.Errorf("Program %v stopped before it was ready", p.Name)
+	case <-timer.C:
+		return fmt.Errorf("Program %v not ready after %v", p.Name, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setReady marks the program as ready, once.
+func (p *Program) setReady() {
+	p.readyOnce.Do(func() {
+		close(p.ready)
+		if p.Config.Ready != nil {
+			p.event("ready")
+		}
+	})
+}
+
+// probe checks whether a launched program is ready, every "ready.interval"
+// seconds, till it is ready or stops running. Only tcp and http probes are
+// checked, log probes are matched with program's output.
+func (p *Program) probe(probe *api.ReadyProbe) {
+	interval := time.Duration(probe.Interval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := p.probeOnce(ctx, probe)
+		cancel()
+		if err == nil {
+			p.setReady()
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *Program) probeOnce(ctx context.Context, probe *api.ReadyProbe) error {
+	host, user := p.Config.TargetHost, p.Config.User
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.fabric.dial(ctx, host, user, addr)
+	}
+	switch {
+	case probe.TCP != "":
+		addr := probe.TCP
+		if strings.HasPrefix(addr, ":") {
+			addr = "localhost" + addr
+		}
+		conn, err := dial(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case probe.HTTP != "":
+		client := &http.Client{
+			Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true},
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", probe.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%v responded %v", probe.HTTP, resp.Status)
+		}
+	}
+	return nil
+}
+
+// dial connects to `addr` as seen from `host`, through the ssh connection
+// to `host` as `user`, or directly for the local host.
+func (fabric *Fabric) dial(ctx context.Context, host, user, addr string) (net.Conn, error) {
+	if isLocalHost(host, user) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	cp, err := fabric.getConnectionPool(host, user)
+	if err != nil {
+		return nil, err
+	}
+	client, release, err := cp.Share(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &pooledConn{Conn: conn, release: release}, nil
+}
+
+// pooledConn is a connection tunneled over a shared ssh connection, which
+// is released to its pool when closed.
+type pooledConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,212 @@
+package sshc
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ExecCaptureSize is the number of bytes of stdout, and of stderr, captured
+// in ExecResult unless the command asks for more. Only the tail of a longer
+// output is kept.
+var ExecCaptureSize = 64 * 1024
+
+// ExecResult is the outcome of a command executed on a host.
+type ExecResult struct {
+	Command    string
+	ExitStatus int    // -1 if the command was killed by cbsh or lost
+	Signal     string // that terminated the command, like "TERM"
+	Duration   time.Duration
+	Stdout     string // tail of output, refer ExecCaptureSize
+	Stderr     string
+	Truncated  bool // whether Stdout or Stderr lost their head
+
+	start  time.Time
+	stdout *tailBuffer
+	stderr *tailBuffer
+}
+
+func newExecResult(cmd *remoteCommand) *ExecResult {
+	size := cmd.capture
+	if size == 0 {
+		size = ExecCaptureSize
+	}
+	return &ExecResult{
+		Command:    cmd.command,
+		ExitStatus: -1,
+		start:      time.Now(),
+		stdout:     &tailBuffer{limit: size},
+		stderr:     &tailBuffer{limit: size},
+	}
+}
+
+// Success tells whether the command exited with status 0.
+func (res *ExecResult) Success() bool {
+	return res.ExitStatus == 0 && res.Signal == ""
+}
+
+// Err returns an error describing an unsuccessful result, nil on success.
+func (res *ExecResult) Err() error {
+	switch {
+	case res.Success():
+		return nil
+	case res.Signal != "":
+		return fmt.Errorf("%q killed by signal %v", res.Command, res.Signal)
+	case res.ExitStatus < 0:
+		return fmt.Errorf("%q did not exit", res.Command)
+	}
+	return fmt.Errorf("%q exited with status %v", res.Command, res.ExitStatus)
+}
+
+// capture copies command's `stdout` and `stderr` into the result, and line
+// by line to cmd.outch and cmd.errch if they are not nil, till cmd.quit is
+// closed. Returned group is done when both are read till EOF, output is
+// drained even after cmd.quit so that the command does not block on write.
+func (res *ExecResult) capture(cmd *remoteCommand, stdout, stderr io.Reader) *sync.WaitGroup {
+	var readers sync.WaitGroup
+	copyOut := func(r io.Reader, b *tailBuffer, ch outStr) {
+		defer readers.Done()
+		r = io.TeeReader(r, b)
+		if ch != nil {
+			readOut(r, ch, cmd.quit)
+		}
+		io.Copy(ioutil.Discard, r)
+	}
+	readers.Add(2)
+	go copyOut(stdout, res.stdout, cmd.outch)
+	go copyOut(stderr, res.stderr, cmd.errch)
+	return &readers
+}
+
+// KillGracePeriod is the time given to a cancelled command to exit after
+// SIGTERM, before it is sent SIGKILL.
+var KillGracePeriod = 5 * time.Second
+
+// wait waits for the command to exit, `done` receives the error from
+// waiting on it, or for a `daemon` till cmd.quit is closed. If `ctx` is
+// cancelled meanwhile, the command is killed using `kill`. Returned error
+// is for failures other than the command's exit status, like a lost
+// connection or cancellation.
+func (res *ExecResult) wait(
+	ctx context.Context, cmd *remoteCommand, daemon bool, done <-chan error,
+	readers *sync.WaitGroup, kill func(ssh.Signal)) (err error) {
+
+	quit := cmd.quit
+	if !daemon {
+		quit = nil // wait for the command to exit.
+	}
+	select {
+	case err = <-done:
+		readers.Wait()
+		res.collect()
+		err = res.exited(err)
+	case <-quit:
+		kill(ssh.SIGTERM)
+		res.Duration = time.Since(res.start)
+		return nil
+	case <-ctx.Done():
+		err = res.cancel(ctx, done, kill)
+	}
+	if cmd.errch != nil {
+		if err != nil {
+			cmd.errch <- fmt.Sprintln(err)
+		} else if err := res.Err(); err != nil {
+			cmd.errch <- fmt.Sprintln(err)
+		}
+	}
+	if daemon {
+		func() {
+			defer func() { recover() }()
+			close(cmd.quit)
+		}()
+	}
+	return err
+}
+
+// cancel kills the command for cancelled `ctx`, with SIGTERM followed by
+// SIGKILL after KillGracePeriod, and waits for it to exit. Output of a
+// cancelled command is not collected.
+func (res *ExecResult) cancel(
+	ctx context.Context, done <-chan error, kill func(ssh.Signal)) error {
+
+	kill(ssh.SIGTERM)
+	timer := time.NewTimer(KillGracePeriod)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		res.exited(err)
+	case <-timer.C:
+		kill(ssh.SIGKILL)
+		timer.Reset(KillGracePeriod)
+		select {
+		case err := <-done:
+			res.exited(err)
+		case <-timer.C: // neither the command nor its host respond
+			res.Duration = time.Since(res.start)
+		}
+	}
+	return fmt.Errorf("%q cancelled: %v", res.Command, ctx.Err())
+}
+
+// collect copies captured output into the result, once the readers are
+// done.
+func (res *ExecResult) collect() {
+	res.Stdout, res.Stderr = res.stdout.String(), res.stderr.String()
+	res.Truncated = res.stdout.truncated() || res.stderr.truncated()
+}
+
+// exited fills the exit status of the command from the error returned by
+// waiting for it, returns `err` if it is not about exit status.
+func (res *ExecResult) exited(err error) error {
+	res.Duration = time.Since(res.start)
+	switch e := err.(type) {
+	case nil:
+		res.ExitStatus = 0
+	case *ssh.ExitError:
+		res.ExitStatus, res.Signal = e.ExitStatus(), e.Signal()
+	case *exec.ExitError:
+		res.ExitStatus = e.ExitCode()
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			res.Signal = strings.TrimPrefix(unix.SignalName(ws.Signal()), "SIG")
+		}
+	default:
+		return err
+	}
+	return nil
+}
+
+// tailBuffer keeps the last `limit` bytes written to it, a negative limit
+// keeps everything.
+type tailBuffer struct {
+	limit   int
+	buf     []byte
+	written int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	b.written += len(p)
+	if b.limit >= 0 && len(b.buf) > 2*b.limit { // compact once in a while
+		b.buf = append([]byte(nil), b.buf[len(b.buf)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated() {
+		return string(b.buf[len(b.buf)-b.limit:])
+	}
+	return string(b.buf)
+}
+
+func (b *tailBuffer) truncated() bool {
+	return b.limit >= 0 && b.written > b.limit
+}
@@ -0,0 +1,179 @@
+package sshc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lifecycle states of a program, refer programTransitions.
+const (
+	PROGRAM_STOPPED    = "stopped" // never started, or installed
+	PROGRAM_INSTALLING = "installing"
+	PROGRAM_STARTING   = "starting"
+	PROGRAM_RUNNING    = "running"
+	PROGRAM_EXITED     = "exited" // on its own, refer ExitCode and Signal
+	PROGRAM_KILLED     = "killed"
+	PROGRAM_FAILED     = "failed"     // to install or to start, refer Err
+	PROGRAM_RESTARTING = "restarting" // waiting to restart, refer Restart
+)
+
+// programTransitions lists the states a program can move to from a state,
+// other transitions are ignored, like killing an exited program.
+var programTransitions = map[string][]string{
+	PROGRAM_STOPPED:    {PROGRAM_INSTALLING, PROGRAM_STARTING},
+	PROGRAM_INSTALLING: {PROGRAM_STOPPED, PROGRAM_FAILED},
+	PROGRAM_STARTING:   {PROGRAM_RUNNING, PROGRAM_EXITED, PROGRAM_KILLED, PROGRAM_FAILED},
+	PROGRAM_RUNNING:    {PROGRAM_EXITED, PROGRAM_KILLED, PROGRAM_FAILED},
+	PROGRAM_EXITED:     {PROGRAM_INSTALLING, PROGRAM_STARTING, PROGRAM_RESTARTING},
+	PROGRAM_KILLED:     {PROGRAM_INSTALLING, PROGRAM_STARTING},
+	PROGRAM_FAILED:     {PROGRAM_INSTALLING, PROGRAM_STARTING, PROGRAM_RESTARTING},
+	PROGRAM_RESTARTING: {PROGRAM_STARTING, PROGRAM_KILLED},
+}
+
+// ProgramStatus is the lifecycle state of a configured program. It is kept
+// across restarts of the program.
+type ProgramStatus struct {
+	Name     string
+	Host     string
+	State    string
+	ExitCode int       // for PROGRAM_EXITED, -1 if killed by Signal
+	Signal   string    // for PROGRAM_EXITED
+	Err      error     // for PROGRAM_FAILED
+	Started  time.Time // last time the program was started
+	Stopped  time.Time // last time the program stopped running
+	Restarts int       // number of starts after the first one
+	Restart  time.Time // when a PROGRAM_RESTARTING program is restarted
+	Pid      int       // of the remote shell running the program
+	Pgid     int       // process group of Pid, zero if not known
+
+	owner *Program // last started, stale programs do not update status
+}
+
+// Uptime returns how long a running program has been running.
+func (st *ProgramStatus) Uptime() time.Duration {
+	if st.State != PROGRAM_RUNNING {
+		return 0
+	}
+	return time.Since(st.Started)
+}
+
+// Describe returns state along with exit code, or signal, of an exited
+// program and time left to restart a restarting program.
+func (st *ProgramStatus) Describe() string {
+	switch {
+	case st.State == PROGRAM_EXITED && st.Signal != "":
+		return fmt.Sprintf("%v(%v)", st.State, st.Signal)
+	case st.State == PROGRAM_EXITED:
+		return fmt.Sprintf("%v(%v)", st.State, st.ExitCode)
+	case st.State == PROGRAM_RESTARTING:
+		in := time.Until(st.Restart).Round(time.Second)
+		return fmt.Sprintf("%v(in %v)", st.State, in)
+	}
+	return st.State
+}
+
+// ProgramStatus returns the status of every configured program, in the
+// order of configuration.
+func (fabric *Fabric) ProgramStatus() []*ProgramStatus {
+	fabric.statusMu.Lock()
+	defer fabric.statusMu.Unlock()
+	statuss := make([]*ProgramStatus, 0, len(fabric.Config.Programs))
+	for _, pconf := range fabric.Config.Programs {
+		st := *fabric.getStatus(pconf.Name)
+		st.Host = pconf.TargetHost
+		statuss = append(statuss, &st)
+	}
+	return statuss
+}
+
+// setState moves program `name` to `state`, if it is a valid transition,
+// and updates its status with `update`. Started program `p`, if not nil,
+// moves it only if `p` is the last one started for `name`. Returns whether
+// it moved.
+func (fabric *Fabric) setState(
+	name string, p *Program, state string, update func(st *ProgramStatus)) bool {
+
+	fabric.statusMu.Lock()
+	defer fabric.statusMu.Unlock()
+	st := fabric.getStatus(name)
+	if p != nil && state != PROGRAM_STARTING && st.owner != p {
+		return false
+	}
+	for _, next := range programTransitions[st.State] {
+		if next == state {
+			st.State = state
+			if state == PROGRAM_STARTING {
+				st.owner = p
+			}
+			if update != nil {
+				update(st)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// programPid returns the pid and process group of started program `p`,
+// zero if `p` did not report them or is not the last one started.
+func (fabric *Fabric) programPid(p *Program) (pid, pgid int) {
+	fabric.statusMu.Lock()
+	defer fabric.statusMu.Unlock()
+	if st := fabric.getStatus(p.Name); st.owner == p {
+		return st.Pid, st.Pgid
+	}
+	return 0, 0
+}
+
+// getStatus must be called with statusMu locked.
+func (fabric *Fabric) getStatus(name string) *ProgramStatus {
+	if fabric.status == nil {
+		fabric.status = make(map[string]*ProgramStatus)
+	}
+	st, ok := fabric.status[name]
+	if !ok {
+		st = &ProgramStatus{Name: name, State: PROGRAM_STOPPED}
+		fabric.status[name] = st
+	}
+	return st
+}
+
+// pidMarker prefixes the line, printed before launching a program, that
+// reports the pid of the remote shell running it and its process group.
+const pidMarker = "cbsh:pid:"
+
+// withPid returns `command` of program `name` that first reports its pid
+// and process group, refer parsePid. Process group is left out on hosts
+// without ps.
+func withPid(name, command string) string {
+	pgid := "$(ps -o pgid= -p $$ 2>/dev/null | tr -d ' ')"
+	return fmt.Sprintf("echo %v$$:%v; %v", launchMarker(name), pgid, command)
+}
+
+// launchMarker is the text in the arguments of the shell that launches
+// program `name`, refer withPid, it identifies the program exactly.
+func launchMarker(name string) string {
+	return pidMarker + shellQuote(name, false) + ":"
+}
+
+// parsePid parses the pid, and process group, reported by a command from
+// withPid, like "cbsh:pid:<name>:<pid>:<pgid>". Process group is zero if not
+// reported.
+func parsePid(line string) (pid, pgid int, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, pidMarker) {
+		return 0, 0, false
+	}
+	fields := strings.Split(strings.TrimPrefix(line, pidMarker), ":")
+	if len(fields) < 3 { // name may have ":"
+		return 0, 0, false
+	}
+	pid, err := strconv.Atoi(fields[len(fields)-2])
+	if err != nil {
+		return 0, 0, false
+	}
+	pgid, _ = strconv.Atoi(fields[len(fields)-1])
+	return pid, pgid, true
+}
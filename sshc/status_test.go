@@ -0,0 +1,33 @@
+package sshc
+
+import (
+	"testing"
+)
+
+func TestParsePid(t *testing.T) {
+	testcases := []struct {
+		line      string
+		pid, pgid int
+		ok        bool
+	}{
+		{"cbsh:pid:indexer:123:456", 123, 456, true},
+		{"cbsh:pid:indexer:123:456\r\n", 123, 456, true},
+		{"  cbsh:pid:indexer:123:", 123, 0, true},
+		{"cbsh:pid:indexer:123:x", 123, 0, true},
+		{"cbsh:pid:a:b:123:456", 123, 456, true},
+		{"cbsh:pid::123:456", 123, 456, true},
+		{"cbsh:pid:indexer::456", 0, 0, false},
+		{"cbsh:pid:123:456", 0, 0, false},
+		{"cbsh:pid:", 0, 0, false},
+		{"pid:indexer:123:456", 0, 0, false},
+		{"started cbsh:pid:indexer:123:456", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tc := range testcases {
+		pid, pgid, ok := parsePid(tc.line)
+		if pid != tc.pid || pgid != tc.pgid || ok != tc.ok {
+			t.Errorf("parsePid(%q) expected %v %v %v, got %v %v %v",
+				tc.line, tc.pid, tc.pgid, tc.ok, pid, pgid, ok)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package sshc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TransferProgressInterval is the interval to report progress of a file
+// being copied, files copied quicker are reported once done.
+var TransferProgressInterval = 2 * time.Second
+
+// TransferStats summarise a push or pull.
+type TransferStats struct {
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Push copies local file or directory `local` to `remote` path on `host` as
+// `user`, over sftp on a pooled connection. If `remote` is an existing
+// directory, `local` is copied into it. Relative remote paths are relative
+// to user's home. Checksum of every file copied is verified on `host`.
+func (fabric *Fabric) Push(
+	ctx context.Context, host, user, local, remote string,
+	printch outStr) (*TransferStats, error) {
+
+	return fabric.transfer(ctx, host, user, printch, func(rfs fileSystem) *copier {
+		return &copier{src: localFS{}, dst: rfs, remote: rfs, verb: "push"}
+	}, local, remote)
+}
+
+// Pull copies file or directory `remote` on `host`, as `user`, to `local`
+// path, over sftp on a pooled connection. If `local` is an existing
+// directory, `remote` is copied into it. Checksum of every file copied is
+// verified on `host`.
+func (fabric *Fabric) Pull(
+	ctx context.Context, host, user, remote, local string,
+	printch outStr) (*TransferStats, error) {
+
+	return fabric.transfer(ctx, host, user, printch, func(rfs fileSystem) *copier {
+		return &copier{src: rfs, dst: localFS{}, remote: rfs, verb: "pull"}
+	}, remote, local)
+}
+
+// transfer copies `from` to `to` using the copier made for the file system
+// of `host`. Programs on the local host, refer isLocalHost, are copied to
+// and from local file system.
+func (fabric *Fabric) transfer(
+	ctx context.Context, host, user string, printch outStr,
+	mkCopier func(rfs fileSystem) *copier, from, to string) (*TransferStats, error) {
+
+	var rfs fileSystem
+	if isLocalHost(host, user) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		rfs = localFS{dir: home}
+	} else {
+		cp, err := fabric.getConnectionPool(host, user)
+		if err != nil {
+			return nil, err
+		}
+		client, release, err := cp.Share(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		sc, err := sftp.NewClient(client)
+		if err != nil {
+			return nil, fmt.Errorf("%v@%v: sftp: %v", user, host, err)
+		}
+		defer sc.Close()
+		// checksums are computed one at a time, on a session of their own.
+		sumClient, sumRelease, err := cp.Share(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer sumRelease()
+		rfs = sftpFS{client: sumClient, sftp: sc}
+	}
+
+	c := mkCopier(rfs)
+	c.ctx, c.printch = ctx, printch
+	start := time.Now()
+	err := c.copy(from, to)
+	c.stats.Duration = time.Since(start)
+	return &c.stats, err
+}
+
+// fileSystem abstracts local and remote files for copying. Paths are
+// slash separated.
+type fileSystem interface {
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(name string) error
+	Chmod(name string, mode os.FileMode) error
+	// checksum returns hex encoded sha256 of file's content.
+	checksum(name string) (string, error)
+}
+
+// localFS is the local file system, relative paths are relative to `dir`
+// if it is not empty.
+type localFS struct {
+	dir string
+}
+
+func (fs localFS) path(name string) string {
+	if fs.dir != "" && !filepath.IsAbs(name) {
+		return filepath.Join(fs.dir, name)
+	}
+	return filepath.FromSlash(name)
+}
+
+func (fs localFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(fs.path(name))
+}
+
+func (fs localFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(fs.path(name))
+}
+
+func (fs localFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(fs.path(name))
+}
+
+func (fs localFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(fs.path(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := fs.Stat(path.Join(name, entry.Name())) // follow links
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, renamedInfo{info, entry.Name()})
+	}
+	return infos, nil
+}
+
+func (fs localFS) MkdirAll(name string) error {
+	return os.MkdirAll(fs.path(name), 0755)
+}
+
+func (fs localFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(fs.path(name), mode)
+}
+
+func (fs localFS) checksum(name string) (string, error) {
+	fd, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// renamedInfo is the info of a followed link, under the link's name.
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (info renamedInfo) Name() string {
+	return info.name
+}
+
+// sftpFS is the file system of a remote host, checksums are computed on
+// the host with sha256sum.
+type sftpFS struct {
+	client *ssh.Client // shared for a checksum session at a time
+	sftp   *sftp.Client
+}
+
+func (fs sftpFS) Open(name string) (io.ReadCloser, error) {
+	return fs.sftp.Open(name)
+}
+
+func (fs sftpFS) Create(name string) (io.WriteCloser, error) {
+	return fs.sftp.Create(name)
+}
+
+func (fs sftpFS) Stat(name string) (os.FileInfo, error) {
+	return fs.sftp.Stat(name)
+}
+
+func (fs sftpFS) ReadDir(name string) ([]os.FileInfo, error) {
+	infos, err := fs.sftp.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 { // follow links
+			linked, err := fs.sftp.Stat(path.Join(name, info.Name()))
+			if err != nil {
+				return nil, err
+			}
+			infos[i] = renamedInfo{linked, info.Name()}
+		}
+	}
+	return infos, nil
+}
+
+func (fs sftpFS) MkdirAll(name string) error {
+	return fs.sftp.MkdirAll(name)
+}
+
+func (fs sftpFS) Chmod(name string, mode os.FileMode) error {
+	return fs.sftp.Chmod(name, mode)
+}
+
+func (fs sftpFS) checksum(name string) (string, error) {
+	session, err := fs.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.Output("sha256sum -- " + shellQuote(name, false))
+	if err != nil {
+		return "", fmt.Errorf("sha256sum %v: %v", name, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("sha256sum %v: no output", name)
+	}
+	return strings.TrimPrefix(fields[0], `\`), nil // escaped names
+}
+
+// copier copies files and directories from `src` to `dst` file system,
+// verifying checksums on the `remote` one.
+type copier struct {
+	ctx     context.Context
+	src     fileSystem
+	dst     fileSystem
+	remote  fileSystem
+	verb    string // push or pull
+	printch outStr
+	stats   TransferStats
+}
+
+// copy copies `from` to `to`, or into `to` if it is a directory. Missing
+// parent directories of `to` are created.
+func (c *copier) copy(from, to string) error {
+	info, err := c.src.Stat(from)
+	if err != nil {
+		return err
+	}
+	if dinfo, err := c.dst.Stat(to); err == nil && dinfo.IsDir() {
+		to = path.Join(to, path.Base(filepath.ToSlash(from)))
+	} else if err = c.dst.MkdirAll(path.Dir(to)); err != nil {
+		return err
+	}
+	return c.copyInfo(info, from, to)
+}
+
+func (c *copier) copyInfo(info os.FileInfo, from, to string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		return c.copyDir(info, from, to)
+	case info.Mode().IsRegular():
+		return c.copyFile(info, from, to)
+	}
+	c.printch <- fmt.Sprintf("skipping %v, not a regular file\n", from)
+	return nil
+}
+
+func (c *copier) copyDir(info os.FileInfo, from, to string) error {
+	if err := c.dst.MkdirAll(to); err != nil {
+		return err
+	}
+	infos, err := c.src.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if err := c.copyInfo(info, path.Join(from, name), path.Join(to, name)); err != nil {
+			return err
+		}
+	}
+	return c.dst.Chmod(to, info.Mode().Perm())
+}
+
+// copyFile copies a regular file and verifies its checksum.
+func (c *copier) copyFile(info os.FileInfo, from, to string) (err error) {
+	r, err := c.src.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := c.dst.Create(to)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	p := &progress{c: c, name: from, size: info.Size(), start: time.Now()}
+	p.last = p.start
+	n, err := io.Copy(io.MultiWriter(w, h, p), r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%v %v: %v", c.verb, from, err)
+	}
+	if err = c.dst.Chmod(to, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// verify what was read or written on the remote side.
+	sum, name := hex.EncodeToString(h.Sum(nil)), to
+	if c.remote == c.src {
+		name = from
+	}
+	rsum, err := c.remote.checksum(name)
+	if err != nil {
+		return err
+	} else if rsum != sum {
+		return fmt.Errorf("%v %v: checksum mismatch, %v != %v", c.verb, from, rsum, sum)
+	}
+	c.stats.Files++
+	c.stats.Bytes += n
+	c.printch <- fmt.Sprintf("%v %v -> %v %v in %v, sha256 %.12v\n",
+		c.verb, from, to, byteSize(n), time.Since(p.start).Round(time.Millisecond), sum)
+	return nil
+}
+
+// progress reports bytes copied of a file, every TransferProgressInterval,
+// and stops the copy if the transfer is cancelled.
+type progress struct {
+	c       *copier
+	name    string
+	size    int64
+	written int64
+	start   time.Time
+	last    time.Time
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	if err := p.c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	p.written += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= TransferProgressInterval {
+		p.last = now
+		rate := float64(p.written) / now.Sub(p.start).Seconds()
+		p.c.printch <- fmt.Sprintf("%v %v %v/%v %v/s\n",
+			p.c.verb, p.name, byteSize(p.written), byteSize(p.size), byteSize(int64(rate)))
+	}
+	return len(b), nil
+}
+
+// byteSize formats `n` bytes in KB, MB or GB.
+func byteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%vB", n)
+}